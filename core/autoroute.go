@@ -0,0 +1,70 @@
+package core
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/netip"
+
+	"github.com/yimiaoxiehou/tun2socks/proxy"
+	"github.com/yimiaoxiehou/tun2socks/resolver"
+)
+
+// bypassAddrs resolves the proxy servers and directly dialed DNS servers,
+// which must stay reachable outside the TUN in auto-route mode.
+func (e *Engine) bypassAddrs() ([]netip.Addr, error) {
+	var hosts []string
+	for _, server := range proxy.Servers(e.Outbound) {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+	for _, ob := range e.Outbounds {
+		for _, server := range proxy.Servers(ob) {
+			if host, _, err := net.SplitHostPort(server); err == nil {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	hosts = append(hosts, resolver.DirectServers(e.DNS)...)
+	for _, upstreams := range e.DNSZones {
+		hosts = append(hosts, resolver.DirectServers(upstreams)...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	seen := map[netip.Addr]bool{}
+	var addrs []netip.Addr
+	for _, host := range hosts {
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if ip = ip.Unmap(); !seen[ip] && !ip.IsLoopback() {
+				seen[ip] = true
+				addrs = append(addrs, ip)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// bindDefaultInterface keeps the engine's own sockets on the interface of
+// the former default route, unless they are already marked or bound.
+// Sockets to loopback addresses, such as the default DNS upstream
+// 127.0.0.1:53, are not bound.
+func (e *Engine) bindDefaultInterface(name string) {
+	opts := proxy.SocketOptions{}
+	if e.Socket != nil {
+		opts = *e.Socket
+	}
+	if opts.Mark != 0 || opts.Interface != "" || opts.Protect != nil || name == "" {
+		return
+	}
+	opts.Interface = name
+	proxy.SetSocketOptions(opts)
+	log.Printf("Binding outgoing sockets to %s", name)
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yimiaoxiehou/tun2socks/proxy"
+)
+
+// defaultDNS is used when neither DNS nor Resolver is set.
+const defaultDNS = "udp://127.0.0.1:53"
+
+// serveDNS answers the queries a client sends from one port until it has
+// been idle for the DNS timeout. Queries are answered concurrently.
+func (e *Engine) serveDNS(conn CommUDPConn) error {
+	timeout := e.udpTimeout(53)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp := e.answerDNS(buf[:n]); resp != nil {
+				conn.Write(resp)
+			}
+		}()
+	}
+}
+
+// answerDNS answers a query from the hosts and block lists first, then
+// from the fake-ip pool when enabled, otherwise through the resolver.
+func (e *Engine) answerDNS(query []byte) []byte {
+	if resp, ok := e.Resolver.AnswerLocal(query); ok {
+		e.observeRoutes(resp)
+		return resp
+	}
+	if e.FakeIP != nil {
+		if resp, ok := e.FakeIP.ServeDNS(query); ok {
+			return resp
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(e.ctx, dialTimeout)
+	defer cancel()
+	resp, err := e.Resolver.Forward(ctx, query)
+	if err != nil {
+		log.Printf("Error resolving DNS query: %v", err)
+		return nil
+	}
+	e.observeRoutes(resp)
+	return resp
+}
+
+// observeRoutes lets the dynamic routes see a response before the client.
+func (e *Engine) observeRoutes(resp []byte) {
+	if e.routes != nil {
+		e.routes.observe(resp)
+	}
+}
+
+// dnsDialers maps the via names DNS upstreams may use to the outbounds.
+func (e *Engine) dnsDialers() map[string]proxy.Dialer {
+	dialers := map[string]proxy.Dialer{"proxy": proxy.DialerOf(e.Outbound)}
+	for name, ob := range e.Outbounds {
+		dialers[name] = proxy.DialerOf(ob)
+	}
+	return dialers
+}
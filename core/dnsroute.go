@@ -0,0 +1,129 @@
+package core
+
+import (
+	"log"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yimiaoxiehou/tun2socks/tun"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// routeGrace keeps an injected route past the answer TTL so connections
+	// opened just before expiry are not cut off.
+	routeGrace = 5 * time.Minute
+	// routeSweepInterval is how often expired routes are removed.
+	routeSweepInterval = 30 * time.Second
+)
+
+// dnsRoutes installs host routes via the TUN device for the addresses DNS
+// answers return for names under RouteDomains, and removes them once the
+// answer has expired.
+type dnsRoutes struct {
+	domains []string
+	dev     string
+	gateway string
+	table   int
+	changes *tun.Changes
+
+	mu      sync.Mutex
+	expires map[netip.Prefix]time.Time
+}
+
+func newDNSRoutes(domains []string, dev, gateway string, table int, changes *tun.Changes) *dnsRoutes {
+	r := &dnsRoutes{dev: dev, gateway: gateway, table: table, changes: changes, expires: map[netip.Prefix]time.Time{}}
+	for _, d := range domains {
+		r.domains = append(r.domains, strings.Trim(strings.TrimPrefix(strings.ToLower(d), "*."), "."))
+	}
+	return r
+}
+
+// match reports whether name equals or is a subdomain of a pattern.
+func (r *dnsRoutes) match(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for _, d := range r.domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// observe adds or extends routes for the A and AAAA records of a response
+// to a query for a matching name. It returns once the routes are in place,
+// so the client only learns the addresses after they are routed.
+func (r *dnsRoutes) observe(resp []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil || len(msg.Questions) == 0 {
+		return
+	}
+	if !r.match(msg.Questions[0].Name.String()) {
+		return
+	}
+	now := time.Now()
+	for _, a := range msg.Answers {
+		var addr netip.Addr
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			addr = netip.AddrFrom4(body.A)
+		case *dnsmessage.AAAAResource:
+			addr = netip.AddrFrom16(body.AAAA).Unmap()
+		default:
+			continue
+		}
+		if addr.IsUnspecified() || addr.IsLoopback() {
+			continue
+		}
+		r.add(netip.PrefixFrom(addr, addr.BitLen()), now.Add(time.Duration(a.Header.TTL)*time.Second+routeGrace))
+	}
+}
+
+func (r *dnsRoutes) add(prefix netip.Prefix, expires time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.expires[prefix]; ok {
+		if expires.After(old) {
+			r.expires[prefix] = expires
+		}
+		return
+	}
+	if err := r.changes.AddRoute(r.dev, r.gateway, prefix.String(), r.table); err != nil {
+		log.Printf("Error adding route for %s: %v", prefix, err)
+		return
+	}
+	r.expires[prefix] = expires
+}
+
+// sweep removes expired routes until done is closed.
+func (r *dnsRoutes) sweep(done <-chan struct{}) {
+	ticker := time.NewTicker(routeSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			r.removeExpired(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+// removeExpired deletes the routes expiring before now, or all of them
+// when now is zero.
+func (r *dnsRoutes) removeExpired(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for prefix, expires := range r.expires {
+		if !now.IsZero() && expires.After(now) {
+			continue
+		}
+		if err := r.changes.DelRoute(r.dev, r.gateway, prefix.String(), r.table); err != nil {
+			log.Printf("Error removing route for %s: %v", prefix, err)
+		}
+		delete(r.expires, prefix)
+	}
+}
@@ -0,0 +1,44 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"time"
+)
+
+// fakeIPSaveInterval is how often the fake-ip mapping is written to
+// FakeIPFile while running, bounding what a crash loses.
+const fakeIPSaveInterval = time.Minute
+
+// fakeDomain returns the name a fake address was handed out for, or ""
+// when addr is not a fake address. A fake address without a name, evicted
+// or handed out before a restart that lost the mapping, is an error: the
+// address means nothing outside this host and must not be dialed.
+func (e *Engine) fakeDomain(addr netip.Addr) (string, error) {
+	if e.FakeIP == nil || !e.FakeIP.Contains(addr) {
+		return "", nil
+	}
+	name, ok := e.FakeIP.Name(addr)
+	if !ok {
+		return "", fmt.Errorf("fake-ip %s has no name, it may have been evicted", addr)
+	}
+	return name, nil
+}
+
+// saveFakeIP writes the fake-ip mapping to FakeIPFile periodically until
+// done is closed; Stop writes it a last time.
+func (e *Engine) saveFakeIP(done <-chan struct{}) {
+	ticker := time.NewTicker(fakeIPSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.FakeIP.Save(e.FakeIPFile); err != nil {
+				log.Printf("Error saving fake-ip mapping: %v", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
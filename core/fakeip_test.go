@@ -0,0 +1,50 @@
+package core
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/yimiaoxiehou/tun2socks/fakeip"
+)
+
+func TestFakeDomain(t *testing.T) {
+	// A /30 has two usable addresses, so a third name evicts the first.
+	prefix := netip.MustParsePrefix("198.18.0.0/30")
+	pool, err := fakeip.New(prefix, netip.Prefix{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evicted, _ := pool.Lookup("a.example.com")
+	kept, _ := pool.Lookup("b.example.com")
+	pool.Lookup("c.example.com")
+	pool.Lookup("d.example.com")
+
+	// After a restart without the saved mapping no address has a name.
+	restarted, err := fakeip.New(prefix, netip.Prefix{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pool    *fakeip.Pool
+		addr    netip.Addr
+		want    string
+		wantErr bool
+	}{
+		{"evicted name reused", pool, evicted, "c.example.com", false},
+		{"evicted twice", pool, kept, "d.example.com", false},
+		{"lost on restart", restarted, kept, "", true},
+		{"outside the pool", pool, netip.MustParseAddr("192.0.2.1"), "", false},
+		{"no pool", nil, kept, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Engine{FakeIP: tt.pool}
+			got, err := e.fakeDomain(tt.addr)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("fakeDomain(%s) = %q, %v; want %q, error %v", tt.addr, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/yimiaoxiehou/tun2socks/proxy"
+	"github.com/yimiaoxiehou/tun2socks/rule"
+)
+
+// errRejected is returned for flows dropped by a reject rule.
+var errRejected = errors.New("rejected by rule")
+
+// flowMetadata describes a flow captured by the stack. The gVisor endpoint
+// is the destination side, so LocalAddr is where the client was connecting.
+// Fake addresses are resolved back to their name.
+func (e *Engine) flowMetadata(network string, conn CommIPConn) (*rule.Metadata, error) {
+	src, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+	dst, _ := netip.ParseAddrPort(conn.LocalAddr().String())
+	m := &rule.Metadata{
+		Network: network,
+		Src:     netip.AddrPortFrom(src.Addr().Unmap(), src.Port()),
+		Dst:     netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port()),
+	}
+	var err error
+	if m.Domain, err = e.fakeDomain(m.Dst.Addr()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// dialAddr is the "host:port" the outbound connects to: the hostname when
+// known, so the proxy resolves it, otherwise the IP.
+func dialAddr(m *rule.Metadata) string {
+	if m.Domain != "" {
+		return net.JoinHostPort(m.Domain, strconv.Itoa(int(m.Dst.Port())))
+	}
+	return m.Dst.String()
+}
+
+// checkRules makes sure every proxy:<name> action refers to a known outbound.
+func (e *Engine) checkRules() error {
+	if e.Rules == nil {
+		return nil
+	}
+	for _, r := range e.Rules.Rules {
+		if r.Action.Kind == rule.Proxy && r.Action.Outbound != "" {
+			if _, ok := e.Outbounds[r.Action.Outbound]; !ok {
+				return fmt.Errorf("rule %s: unknown outbound %q", r.Action, r.Action.Outbound)
+			}
+		}
+	}
+	return nil
+}
+
+// outboundFor applies the rules to a flow and returns the outbound carrying it.
+func (e *Engine) outboundFor(m *rule.Metadata) (proxy.Outbound, error) {
+	action := e.Rules.Match(m)
+	if m.Domain != "" {
+		log.Printf("%s %s -> %s (%s): %s", m.Network, m.Src, m.Dst, m.Domain, action)
+	} else {
+		log.Printf("%s %s -> %s: %s", m.Network, m.Src, m.Dst, action)
+	}
+	switch action.Kind {
+	case rule.Reject:
+		return nil, errRejected
+	case rule.Direct:
+		return e.direct, nil
+	}
+	if action.Outbound == "" {
+		return e.Outbound, nil
+	}
+	return e.Outbounds[action.Outbound], nil
+}
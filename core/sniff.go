@@ -0,0 +1,91 @@
+package core
+
+import (
+	"time"
+
+	"github.com/yimiaoxiehou/tun2socks/sniff"
+)
+
+const (
+	defaultSniffTimeout = 300 * time.Millisecond
+	// maxSniffLen bounds how much of a flow is buffered while sniffing; it
+	// holds a ClientHello with large key shares.
+	maxSniffLen = 8192
+)
+
+// peekedConn replays the bytes consumed by sniffing before reading on.
+type peekedConn struct {
+	CommTCPConn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.CommTCPConn.Read(b)
+}
+
+// sniffTCP reads the first client bytes of conn to recover the destination
+// hostname. It gives up after SniffTimeout, which server-first protocols
+// such as SSH always hit. The returned conn replays what was read.
+func (e *Engine) sniffTCP(conn CommTCPConn) (CommTCPConn, string) {
+	timeout := e.SniffTimeout
+	if timeout <= 0 {
+		timeout = defaultSniffTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 0, maxSniffLen)
+	var domain string
+	for len(buf) < cap(buf) {
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		name, serr := sniff.Domain(buf)
+		if serr == nil {
+			domain = name
+			break
+		}
+		if serr != sniff.ErrIncomplete || err != nil {
+			break
+		}
+	}
+	return &peekedConn{CommTCPConn: conn, peeked: buf}, domain
+}
+
+// maxSniffDatagrams bounds how many datagrams are held back while waiting
+// for a ClientHello that spans several QUIC Initial packets.
+const maxSniffDatagrams = 4
+
+// sniffUDP reads the first datagrams of a flow and looks for a QUIC Initial
+// ClientHello. The datagrams read are returned so they can be sent on.
+func (e *Engine) sniffUDP(conn CommUDPConn) ([][]byte, string) {
+	timeout := e.SniffTimeout
+	if timeout <= 0 {
+		timeout = defaultSniffTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var pending [][]byte
+	var sniffer sniff.QUICSniffer
+	for len(pending) < maxSniffDatagrams {
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		pending = append(pending, buf[:n])
+		name, serr := sniffer.Feed(buf[:n])
+		if serr == nil {
+			return pending, name
+		}
+		if serr != sniff.ErrIncomplete {
+			break
+		}
+	}
+	return pending, ""
+}
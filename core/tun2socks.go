@@ -4,12 +4,15 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"net"
 	"strings"
+	"time"
 
 	"io"
 
-	"github.com/yimiaoxiehou/tun2socks/socks"
+	"github.com/yimiaoxiehou/tun2socks/fakeip"
+	"github.com/yimiaoxiehou/tun2socks/proxy"
+	"github.com/yimiaoxiehou/tun2socks/resolver"
+	"github.com/yimiaoxiehou/tun2socks/rule"
 	"github.com/yimiaoxiehou/tun2socks/tun"
 
 	"gvisor.dev/gvisor/pkg/buffer"
@@ -20,11 +23,101 @@ import (
 
 type Engine struct {
 	TunDevice string
-	TunAddr   string
-	TunMask   string
-	Mtu       int
-	Sock5Addr string
-	Routers   []string
+	// TunAddr lists the comma-separated IPv4 and IPv6 addresses of the
+	// device, each optionally with a prefix length; TunMask applies to IPv4
+	// addresses without one. Routers lists the IPv4 and IPv6 prefixes routed
+	// to the device.
+	TunAddr string
+	TunMask string
+	Mtu     int
+	Proxy   string // outbound URL such as socks5://host:1080 or direct://
+	Routers []string
+
+	// Outbound carries the tunneled flows. When nil it is built from Proxy.
+	// Stop closes it if it implements io.Closer.
+	Outbound proxy.Outbound
+
+	// Socket, when set, marks or binds every socket the engine and the
+	// outbounds open to reach the network, so that they bypass the TUN.
+	Socket *proxy.SocketOptions
+
+	// AutoRoute sends all traffic through the TUN on Linux, keeping the
+	// proxy and DNS servers on the previous gateway. Stop restores the routes.
+	AutoRoute bool
+
+	// RouteTable, when set, selects policy routing on Linux: the routes go
+	// to this table instead of main, and rules at RulePriority (9000 by
+	// default) make packets without the Socket mark look it up. The mark
+	// defaults to 0x2022 when Socket has none.
+	RouteTable   int
+	RulePriority int
+
+	// Cgroup, when set, captures only the traffic of the processes in this
+	// cgroup v2 path on Linux, which is created if missing: a firewall rule
+	// marks their packets with CgroupMark (0x2023 by default), and a rule
+	// sends marked packets to RouteTable (2022 by default) routing
+	// everything through the TUN.
+	Cgroup     string
+	CgroupMark int
+
+	// StateFile, when set, records the addresses and routes installed
+	// while running. Start first removes those left behind by a previous
+	// run that did not Stop, e.g. after a crash.
+	StateFile string
+
+	// Rules choose per flow between Outbound, a named entry of Outbounds,
+	// a direct connection or rejection. A nil Rules proxies everything.
+	Rules     *rule.Set
+	Outbounds map[string]proxy.Outbound
+
+	// FakeIP answers intercepted A/AAAA queries with addresses from its
+	// pool; flows to those addresses are proxied by hostname. The mapping
+	// is loaded from FakeIPFile when set, and saved to it every minute and
+	// on Stop.
+	FakeIP     *fakeip.Pool
+	FakeIPFile string
+
+	// Sniff peeks at the first bytes of TCP flows for a TLS SNI or HTTP
+	// Host, and at the first datagrams of UDP flows for a QUIC ClientHello,
+	// waiting at most SniffTimeout (300ms by default).
+	Sniff        bool
+	SniffTimeout time.Duration
+
+	// DNS lists the upstream URLs intercepted queries are forwarded to,
+	// comma-separated, e.g. "udp://8.8.8.8:53,https://1.1.1.1/dns-query".
+	// An upstream with ?via=proxy is tunneled through Outbound, ?via=<name>
+	// through that entry of Outbounds. Resolver, when set, takes precedence.
+	DNS      string
+	Resolver *resolver.Resolver
+
+	// DNSZones maps domain suffixes to the upstream URLs, in the format of
+	// DNS, that resolve them instead. DNSHosts, DNSBlock and DNSCache, when
+	// set, are used by the resolver built from DNS.
+	DNSZones map[string]string
+	DNSHosts *resolver.Hosts
+	DNSBlock *resolver.Blocklist
+	DNSCache *resolver.Cache
+
+	// RouteDomains lists domain suffixes, optionally written as *.suffix,
+	// whose DNS answers get host routes via the TUN device for as long as
+	// the answer lives, so that only those destinations are captured.
+	RouteDomains []string
+
+	// UDPTimeout closes a UDP session idle for this long, 60s by default.
+	// UDPPortTimeouts overrides it per destination port; ports it does not
+	// list keep the defaults, 10s for DNS. UDPNAT selects NATSymmetric (the default) or NATFullCone
+	// mapping, and MaxUDPSessions caps the sessions open at once when set.
+	UDPTimeout      time.Duration
+	UDPPortTimeouts map[uint16]time.Duration
+	UDPNAT          string
+	MaxUDPSessions  int
+
+	direct    proxy.Outbound
+	autoRoute *tun.AutoRoute
+	policy    *tun.Policy
+	changes   *tun.Changes
+	udp       *udpTable
+	routes    *dnsRoutes
 	dev       io.ReadWriteCloser
 	ctx       context.Context
 	cancel    context.CancelFunc
@@ -36,15 +129,148 @@ func (e *Engine) Start() error {
 
 	log.Println("Start")
 
+	if e.RouteTable != 0 && e.Cgroup == "" && (e.Socket == nil || e.Socket.Mark == 0) {
+		// The rules send every packet without the mark to the table, so
+		// unmarked outbound sockets would loop back into the TUN.
+		socket := proxy.SocketOptions{}
+		if e.Socket != nil {
+			socket = *e.Socket
+		}
+		socket.Mark = tun.DefaultSocketMark
+		e.Socket = &socket
+	}
+	if e.Socket != nil {
+		proxy.SetSocketOptions(*e.Socket)
+	}
+
+	if e.Outbound == nil {
+		e.Outbound, err = proxy.New(e.Proxy)
+		if err != nil {
+			return err
+		}
+	}
+	if err = e.checkRules(); err != nil {
+		return err
+	}
+	if e.direct = e.Outbounds[rule.Direct]; e.direct == nil {
+		if e.direct, err = proxy.New("direct://"); err != nil {
+			return err
+		}
+	}
+
+	switch e.UDPNAT {
+	case "", NATSymmetric, NATFullCone:
+	default:
+		return fmt.Errorf("unknown UDP NAT mode %q", e.UDPNAT)
+	}
+	e.udp = newUDPTable(e.MaxUDPSessions)
+
+	if e.Resolver == nil {
+		dns := e.DNS
+		if dns == "" {
+			dns = defaultDNS
+		}
+		dialers := e.dnsDialers()
+		if e.Resolver, err = resolver.New(dns, dialers); err != nil {
+			return err
+		}
+		for suffix, upstreams := range e.DNSZones {
+			if err = e.Resolver.AddZone(suffix, upstreams, dialers); err != nil {
+				return err
+			}
+		}
+		e.Resolver.Hosts = e.DNSHosts
+		e.Resolver.Block = e.DNSBlock
+		e.Resolver.Cache = e.DNSCache
+	}
+	if e.FakeIP != nil {
+		if e.FakeIPFile != "" {
+			if err = e.FakeIP.Load(e.FakeIPFile); err != nil {
+				return err
+			}
+		}
+		prefix4, prefix6 := e.FakeIP.Prefixes()
+		e.Routers = append(e.Routers, prefix4.String())
+		if prefix6.IsValid() {
+			e.Routers = append(e.Routers, prefix6.String())
+		}
+	}
+
+	if e.AutoRoute {
+		bypass, err := e.bypassAddrs()
+		if err != nil {
+			return err
+		}
+		e.autoRoute = &tun.AutoRoute{Bypass: bypass}
+	}
+
+	if e.RouteTable != 0 || e.Cgroup != "" {
+		e.policy = &tun.Policy{
+			Table:      e.RouteTable,
+			Priority:   e.RulePriority,
+			Cgroup:     e.Cgroup,
+			CgroupMark: e.CgroupMark,
+		}
+		if e.Socket != nil {
+			e.policy.Mark = e.Socket.Mark
+		}
+	}
+	if e.Cgroup != "" {
+		if e.policy.Table == 0 {
+			e.policy.Table = tun.DefaultRouteTable
+		}
+		if e.policy.CgroupMark == 0 {
+			e.policy.CgroupMark = tun.DefaultCgroupMark
+		}
+		if e.policy.CgroupMark == e.policy.Mark {
+			return fmt.Errorf("cgroup mark %#x equals the socket mark, outbound sockets would loop into the TUN", e.policy.Mark)
+		}
+		// Only marked packets reach the table, so the proxy servers need
+		// no bypass routes.
+		if e.autoRoute == nil {
+			e.autoRoute = &tun.AutoRoute{}
+		}
+	}
+
+	if e.StateFile != "" {
+		if err := tun.Recover(e.StateFile); err != nil {
+			log.Printf("Error removing routes of the previous run: %v", err)
+		}
+	}
+	e.changes = tun.NewChanges(e.StateFile)
+
 	// Register and initialize the TUN device
-	e.dev, err = tun.RegTunDev(e.TunDevice, e.Mtu, e.TunAddr, e.TunMask, e.Routers)
+	e.dev, err = tun.RegTunDev(e.TunDevice, e.Mtu, e.TunAddr, e.TunMask, e.Routers, e.autoRoute, e.policy, e.changes)
 	if err != nil {
+		if uerr := e.changes.Undo(); uerr != nil {
+			log.Printf("Error restoring routes: %v", uerr)
+		}
 		return err // Return error if TUN device initialization fails
 	}
+	if e.AutoRoute {
+		e.bindDefaultInterface(e.autoRoute.Interface)
+	}
 
 	// Create a cancellable context for the engine
 	e.ctx, e.cancel = context.WithCancel(context.Background())
 
+	if e.FakeIP != nil && e.FakeIPFile != "" {
+		go e.saveFakeIP(e.ctx.Done())
+	}
+
+	if len(e.RouteDomains) > 0 {
+		name := e.TunDevice
+		if named, ok := e.dev.(interface{ Name() string }); ok {
+			name = named.Name()
+		}
+		table := 0
+		if e.policy != nil {
+			table = e.policy.Table
+		}
+		e.routes = newDNSRoutes(e.RouteDomains, name, e.gateway(), table, e.changes)
+		go e.routes.sweep(e.ctx.Done())
+	}
+
 	// Start the main processing goroutine
 	go func() {
 		// Ensure the wait group counter is decremented when the goroutine exits
@@ -61,10 +287,39 @@ func (e *Engine) Start() error {
 	return nil // Return nil if startup was successful
 }
 
+// gateway returns the first IPv4 address of the device, which IPv4 routes
+// to it go through.
+func (e *Engine) gateway() string {
+	addrs, _ := tun.ParseAddrs(e.TunAddr, e.TunMask)
+	if gw := tun.Gateway4(addrs); gw.IsValid() {
+		return gw.String()
+	}
+	return ""
+}
+
 func (e *Engine) Stop() error {
 	if e.cancel != nil {
 		e.cancel()
 	}
+	if closer, ok := e.Outbound.(io.Closer); ok {
+		closer.Close()
+	}
+	if e.routes != nil {
+		e.routes.removeExpired(time.Time{})
+	}
+	if err := e.changes.Undo(); err != nil {
+		log.Printf("Error restoring routes: %v", err)
+	}
+	if e.FakeIP != nil && e.FakeIPFile != "" {
+		if err := e.FakeIP.Save(e.FakeIPFile); err != nil {
+			log.Printf("Error saving fake-ip mapping: %v", err)
+		}
+	}
+	for _, ob := range e.Outbounds {
+		if closer, ok := ob.(io.Closer); ok && ob != e.Outbound {
+			closer.Close()
+		}
+	}
 	if e.dev != nil {
 		err := e.dev.Close()
 		if err != nil {
@@ -78,15 +333,35 @@ func (e *Engine) rawUdpForwarder(conn CommUDPConn, ep CommEndpoint) error {
 	defer conn.Close()
 	//dns port
 	if strings.HasSuffix(conn.LocalAddr().String(), ":53") {
-		dnsReq(conn, "udp", "127.0.0.1:53")
+		return e.serveDNS(conn)
 	}
-	return nil
+	return e.relayUdp(conn)
 }
 
+// dialTimeout bounds how long an outbound may take to connect a new flow.
+const dialTimeout = 10 * time.Second
+
 func (e *Engine) rawTcpForwarder(conn CommTCPConn) error {
-	socksConn, err := socks.NewConn(e.Sock5Addr)
+	meta, err := e.flowMetadata("tcp", conn)
 	if err != nil {
-		log.Printf("Error creating SOCKS connection: %v", err)
+		log.Printf("Error handling %s: %v", conn.LocalAddr(), err)
+		conn.Close()
+		return err
+	}
+	if e.Sniff && meta.Domain == "" {
+		conn, meta.Domain = e.sniffTCP(conn)
+	}
+	outbound, err := e.outboundFor(meta)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	ctx, cancel := context.WithTimeout(e.ctx, dialTimeout)
+	remote, err := outbound.DialTCP(ctx, dialAddr(meta))
+	cancel()
+	if err != nil {
+		log.Printf("Error connecting to %s: %v", conn.LocalAddr(), err)
+		conn.Close()
 		return err
 	}
 	defer func() {
@@ -94,26 +369,20 @@ func (e *Engine) rawTcpForwarder(conn CommTCPConn) error {
 		if err := conn.Close(); err != nil && err != io.EOF {
 			log.Printf("Error closing CommTCPConn: %v", err)
 		}
-		if err := socksConn.Close(); err != nil && err != io.EOF {
-			log.Printf("Error closing SOCKS connection: %v", err)
+		if err := remote.Close(); err != nil && err != io.EOF {
+			log.Printf("Error closing outbound connection: %v", err)
 		}
 	}()
 
-	log.Println("connect to " + conn.LocalAddr().String())
-	if err := socks.SocksCmd(socksConn, uint8(socks.SOCKS5_CONNECT_CMD), conn.LocalAddr().String()); err != nil {
-		log.Printf("SOCKS command failed: %v", err)
-		return err
-	}
-
 	errChan := make(chan error, 2)
 
 	go func() {
-		_, err := io.Copy(socksConn, conn)
+		_, err := io.Copy(remote, conn)
 		errChan <- err
 	}()
 
 	go func() {
-		_, err := io.Copy(conn, socksConn)
+		_, err := io.Copy(conn, remote)
 		errChan <- err
 	}()
 
@@ -172,50 +441,3 @@ func (e *Engine) ForwardTransportFromIo(ctx context.Context, dev io.ReadWriter,
 	}
 	return nil
 }
-
-/*to dns*/
-func dnsReq(conn CommUDPConn, action string, dnsAddr string) error {
-	if action == "tcp" {
-		dnsConn, err := net.Dial(action, dnsAddr)
-		if err != nil {
-			fmt.Println(err.Error())
-			return err
-		}
-		defer dnsConn.Close()
-		go io.Copy(conn, dnsConn)
-		io.Copy(dnsConn, conn)
-		fmt.Printf("dnsReq Tcp\r\n")
-		return nil
-	} else {
-		buf := make([]byte, 4096)
-		var n = 0
-		var err error
-		n, err = conn.Read(buf)
-		if err != nil {
-			fmt.Printf("c.Read() = %v", err)
-			return err
-		}
-		dnsConn, err := net.Dial("udp", dnsAddr)
-		if err != nil {
-			fmt.Println(err.Error())
-			return err
-		}
-		defer dnsConn.Close()
-		_, err = dnsConn.Write(buf[:n])
-		if err != nil {
-			fmt.Println(err.Error())
-			return err
-		}
-		n, err = dnsConn.Read(buf)
-		if err != nil {
-			fmt.Println(err.Error())
-			return err
-		}
-		_, err = conn.Write(buf[:n])
-		if err != nil {
-			fmt.Println(err.Error())
-			return err
-		}
-	}
-	return nil
-}
@@ -0,0 +1,347 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/yimiaoxiehou/tun2socks/proxy"
+	"github.com/yimiaoxiehou/tun2socks/socks"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// UDP mapping behaviours, see Engine.UDPNAT.
+const (
+	// NATSymmetric gives every session its own outbound socket, so replies
+	// are only accepted from the destination the client sent to.
+	NATSymmetric = "symmetric"
+	// NATFullCone shares one outbound socket between all sessions of a
+	// client port, and delivers datagrams from any remote host to it.
+	NATFullCone = "full-cone"
+)
+
+// defaultUDPTimeout closes a UDP session idle for this long when neither
+// UDPTimeout nor a port timeout applies.
+const defaultUDPTimeout = 60 * time.Second
+
+// defaultUDPPortTimeouts shortens the idle timeout of request/response
+// protocols.
+var defaultUDPPortTimeouts = map[uint16]time.Duration{53: 10 * time.Second}
+
+var errTooManySessions = errors.New("too many UDP sessions")
+
+// udpKey is the 5-tuple of a session; the protocol is always UDP.
+type udpKey struct {
+	src, dst netip.AddrPort
+}
+
+// udpSession is one client flow captured by the stack, relayed through
+// the outbound socket of its mapping.
+type udpSession struct {
+	key     udpKey
+	conn    CommUDPConn
+	target  net.Addr
+	timeout time.Duration
+	m       *udpMapping
+}
+
+// touch pushes the idle deadline of the session back.
+func (s *udpSession) touch() {
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+}
+
+// udpMapping is an outbound socket and the sessions whose replies it
+// carries: one session when symmetric, every session of a client port
+// through the same outbound when full-cone.
+type udpMapping struct {
+	key      any
+	pc       net.PacketConn
+	src      netip.AddrPort
+	sessions map[netip.AddrPort]*udpSession // by destination
+}
+
+// fullConeKey identifies a shared full-cone mapping.
+type fullConeKey struct {
+	src      netip.AddrPort
+	outbound proxy.Outbound
+}
+
+// udpTable holds the UDP sessions and their outbound mappings.
+type udpTable struct {
+	max int
+
+	mu       sync.Mutex
+	sessions map[udpKey]*udpSession
+	mappings map[any]*udpMapping
+}
+
+func newUDPTable(max int) *udpTable {
+	return &udpTable{
+		max:      max,
+		sessions: map[udpKey]*udpSession{},
+		mappings: map[any]*udpMapping{},
+	}
+}
+
+// udpTimeout returns the idle timeout for sessions to port.
+func (e *Engine) udpTimeout(port uint16) time.Duration {
+	if t, ok := e.UDPPortTimeouts[port]; ok {
+		return t
+	}
+	if t, ok := defaultUDPPortTimeouts[port]; ok {
+		return t
+	}
+	if e.UDPTimeout > 0 {
+		return e.UDPTimeout
+	}
+	return defaultUDPTimeout
+}
+
+// relayUdp forwards datagrams between the gVisor UDP endpoint and the proxy
+// through the outbound until the session goes idle.
+func (e *Engine) relayUdp(conn CommUDPConn) error {
+	meta, err := e.flowMetadata("udp", conn)
+	if err != nil {
+		log.Printf("Error handling %s: %v", conn.LocalAddr(), err)
+		return err
+	}
+
+	// Fake addresses are sent to the proxy by name. A name sniffed from
+	// QUIC only drives the rules and logs; datagrams keep the client's IP.
+	dialDst := dialAddr(meta)
+	var target net.Addr = conn.LocalAddr()
+	if meta.Domain != "" {
+		target = &socks.Addr{Name: meta.Domain, Port: meta.Dst.Port()}
+	}
+	// Replies to a name cannot be told apart by source, so only sessions
+	// to an address may share a full-cone mapping.
+	fullCone := e.UDPNAT == NATFullCone && meta.Domain == ""
+	var pending [][]byte
+	if e.Sniff && meta.Domain == "" {
+		pending, meta.Domain = e.sniffUDP(conn)
+	}
+
+	outbound, err := e.outboundFor(meta)
+	if err != nil {
+		return err
+	}
+	s := &udpSession{
+		key:     udpKey{meta.Src, meta.Dst},
+		conn:    conn,
+		target:  target,
+		timeout: e.udpTimeout(meta.Dst.Port()),
+	}
+	var mkey any = s.key
+	if fullCone {
+		mkey = fullConeKey{meta.Src, outbound}
+	}
+	if err := e.udp.open(e.ctx, s, mkey, outbound, dialDst, e.replyUdp); err != nil {
+		log.Printf("Error creating UDP relay to %s: %v", meta.Dst, err)
+		return err
+	}
+	defer e.udp.close(s)
+
+	for _, b := range pending {
+		if _, err := s.m.pc.WriteTo(b, target); err != nil {
+			return err
+		}
+	}
+
+	s.touch()
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil
+			}
+			return err
+		}
+		s.touch()
+		if _, err := s.m.pc.WriteTo(buf[:n], target); err != nil {
+			return err
+		}
+	}
+}
+
+// open registers s, attaching it to the mapping under mkey or to a new one
+// dialed through outbound. New mappings get a pump delivering replies.
+func (t *udpTable) open(ctx context.Context, s *udpSession, mkey any, outbound proxy.Outbound, dst string,
+	reply func(m *udpMapping, b []byte, from net.Addr)) error {
+	t.mu.Lock()
+	if t.max > 0 && len(t.sessions) >= t.max {
+		t.mu.Unlock()
+		return errTooManySessions
+	}
+	if _, ok := t.sessions[s.key]; ok {
+		t.mu.Unlock()
+		return fmt.Errorf("duplicate UDP session %s -> %s", s.key.src, s.key.dst)
+	}
+	t.sessions[s.key] = s
+	if m, ok := t.mappings[mkey]; ok {
+		m.sessions[s.key.dst] = s
+		s.m = m
+		t.mu.Unlock()
+		return nil
+	}
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	pc, err := outbound.DialUDP(ctx, dst)
+	cancel()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		delete(t.sessions, s.key)
+		return err
+	}
+	// Another session of the same client may have dialed meanwhile.
+	if m, ok := t.mappings[mkey]; ok {
+		pc.Close()
+		m.sessions[s.key.dst] = s
+		s.m = m
+		return nil
+	}
+	m := &udpMapping{key: mkey, pc: pc, src: s.key.src, sessions: map[netip.AddrPort]*udpSession{s.key.dst: s}}
+	t.mappings[mkey] = m
+	s.m = m
+	go t.pump(m, reply)
+	return nil
+}
+
+// close removes s and closes its mapping once no session uses it.
+func (t *udpTable) close(s *udpSession) {
+	s.conn.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, s.key)
+	m := s.m
+	if m.sessions[s.key.dst] == s {
+		delete(m.sessions, s.key.dst)
+	}
+	if len(m.sessions) == 0 && t.mappings[m.key] == m {
+		delete(t.mappings, m.key)
+		m.pc.Close()
+	}
+}
+
+// pump reads replies from the outbound socket of m until it is closed.
+func (t *udpTable) pump(m *udpMapping, reply func(m *udpMapping, b []byte, from net.Addr)) {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := m.pc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		reply(m, buf[:n], from)
+	}
+	// The socket failed or was closed: end the sessions still using it.
+	t.mu.Lock()
+	for _, s := range m.sessions {
+		s.conn.Close()
+	}
+	t.mu.Unlock()
+}
+
+// session returns the session of m a reply from from belongs to. A
+// symmetric mapping has one session, which only accepts replies from its
+// destination unless that was sent to by name.
+func (t *udpTable) session(m *udpMapping, from netip.AddrPort) *udpSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, fullCone := m.key.(fullConeKey); fullCone {
+		return m.sessions[from]
+	}
+	for _, s := range m.sessions {
+		if _, byName := s.target.(*socks.Addr); byName || from == s.key.dst {
+			return s
+		}
+	}
+	return nil
+}
+
+// replyUdp delivers a datagram read from the outbound socket of m. Under
+// full-cone mapping datagrams from hosts the client has not sent to are
+// written to the TUN device as if they came from that host.
+func (e *Engine) replyUdp(m *udpMapping, b []byte, from net.Addr) {
+	var src netip.AddrPort
+	switch addr := from.(type) {
+	case *net.UDPAddr:
+		src = addr.AddrPort()
+	case *socks.Addr:
+		if ip, ok := netip.AddrFromSlice(addr.IP); ok {
+			src = netip.AddrPortFrom(ip, addr.Port)
+		}
+	}
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+
+	if s := e.udp.session(m, src); s != nil {
+		s.touch()
+		s.conn.Write(b)
+		return
+	}
+	if _, fullCone := m.key.(fullConeKey); !fullCone || !src.IsValid() || src.Addr().Is4() != m.src.Addr().Is4() {
+		return
+	}
+	if _, err := e.dev.Write(udpPacket(src, m.src, b)); err != nil {
+		log.Printf("Error writing UDP from %s to %s: %v", src, m.src, err)
+	}
+}
+
+// udpPacket builds an IP packet carrying a UDP datagram from src to dst.
+func udpPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	srcAddr := tcpip.AddrFromSlice(src.Addr().AsSlice())
+	dstAddr := tcpip.AddrFromSlice(dst.Addr().AsSlice())
+	udpLen := header.UDPMinimumSize + len(payload)
+
+	var pkt []byte
+	var ipLen int
+	if src.Addr().Is4() {
+		ipLen = header.IPv4MinimumSize
+		pkt = make([]byte, ipLen+udpLen)
+		ip := header.IPv4(pkt)
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(pkt)),
+			TTL:         64,
+			Protocol:    uint8(header.UDPProtocolNumber),
+			SrcAddr:     srcAddr,
+			DstAddr:     dstAddr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+	} else {
+		ipLen = header.IPv6MinimumSize
+		pkt = make([]byte, ipLen+udpLen)
+		header.IPv6(pkt).Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(udpLen),
+			TransportProtocol: header.UDPProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           srcAddr,
+			DstAddr:           dstAddr,
+		})
+	}
+
+	udp := header.UDP(pkt[ipLen:])
+	udp.Encode(&header.UDPFields{
+		SrcPort: src.Port(),
+		DstPort: dst.Port(),
+		Length:  uint16(udpLen),
+	})
+	copy(udp.Payload(), payload)
+	xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, srcAddr, dstAddr, uint16(udpLen))
+	xsum = checksum.Checksum(payload, xsum)
+	// An all-zero checksum means none, so a computed zero is sent as 0xffff.
+	if xsum = ^udp.CalculateChecksum(xsum); xsum == 0 {
+		xsum = 0xffff
+	}
+	udp.SetChecksum(xsum)
+	return pkt
+}
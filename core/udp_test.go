@@ -0,0 +1,238 @@
+package core
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubUDPOutbound hands out stubPacketConns and counts the dials.
+type stubUDPOutbound struct {
+	dials atomic.Int32
+	mu    sync.Mutex
+	pcs   []*stubPacketConn
+}
+
+func (o *stubUDPOutbound) DialTCP(ctx context.Context, dst string) (net.Conn, error) {
+	return nil, net.ErrClosed
+}
+
+func (o *stubUDPOutbound) DialUDP(ctx context.Context, dst string) (net.PacketConn, error) {
+	o.dials.Add(1)
+	pc := &stubPacketConn{written: make(chan []byte, 16), closed: make(chan struct{})}
+	o.mu.Lock()
+	o.pcs = append(o.pcs, pc)
+	o.mu.Unlock()
+	return pc, nil
+}
+
+// stubPacketConn records the datagrams written to it. ReadFrom blocks
+// until it is closed.
+type stubPacketConn struct {
+	net.PacketConn
+	written chan []byte
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (pc *stubPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pc.written <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (pc *stubPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	<-pc.closed
+	return 0, nil, net.ErrClosed
+}
+
+func (pc *stubPacketConn) Close() error {
+	pc.once.Do(func() { close(pc.closed) })
+	return nil
+}
+
+func (pc *stubPacketConn) isClosed() bool {
+	select {
+	case <-pc.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// nopUDPConn stands in for the gVisor side of a session that is never read.
+type nopUDPConn struct{ CommUDPConn }
+
+func (nopUDPConn) Close() error { return nil }
+
+func TestUDPTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		ports   map[uint16]time.Duration
+		port    uint16
+		want    time.Duration
+	}{
+		{"default", 0, nil, 443, defaultUDPTimeout},
+		{"default dns", 0, nil, 53, 10 * time.Second},
+		{"global", 2 * time.Minute, nil, 443, 2 * time.Minute},
+		{"global keeps dns default", 2 * time.Minute, nil, 53, 10 * time.Second},
+		{"port override", 2 * time.Minute, map[uint16]time.Duration{443: 5 * time.Minute}, 443, 5 * time.Minute},
+		{"port overrides dns default", 0, map[uint16]time.Duration{53: 30 * time.Second}, 53, 30 * time.Second},
+		{"other port keeps dns default", 0, map[uint16]time.Duration{443: time.Minute}, 53, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		e := &Engine{UDPTimeout: tt.timeout, UDPPortTimeouts: tt.ports}
+		if got := e.udpTimeout(tt.port); got != tt.want {
+			t.Errorf("%s: udpTimeout(%d) = %v, want %v", tt.name, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestUDPIdleExpiry(t *testing.T) {
+	// The engine side of the session: its local address is the destination
+	// the client sent to, as with gVisor endpoints.
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := net.DialUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, client.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := conn.LocalAddr().(*net.UDPAddr)
+
+	ob := &stubUDPOutbound{}
+	const timeout = 100 * time.Millisecond
+	e := &Engine{
+		Outbound:        ob,
+		UDPPortTimeouts: map[uint16]time.Duration{uint16(dst.Port): timeout},
+		udp:             newUDPTable(0),
+		ctx:             context.Background(),
+	}
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() { errc <- e.relayUdp(conn) }()
+
+	if _, err := client.WriteTo([]byte("ping"), dst); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-errc:
+		t.Fatal("session ended before going idle")
+	case <-time.After(timeout / 2):
+	}
+	ob.mu.Lock()
+	if len(ob.pcs) != 1 {
+		t.Fatalf("dialed %d outbound sockets, want 1", len(ob.pcs))
+	}
+	pc := ob.pcs[0]
+	ob.mu.Unlock()
+	if b := <-pc.written; string(b) != "ping" {
+		t.Errorf("relayed %q, want ping", b)
+	}
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("idle session ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle session was not closed")
+	}
+	if d := time.Since(start); d < timeout {
+		t.Errorf("session closed after %v, before its %v timeout", d, timeout)
+	}
+	if !pc.isClosed() {
+		t.Error("outbound socket of the expired session still open")
+	}
+	if n := len(e.udp.sessions) + len(e.udp.mappings); n != 0 {
+		t.Errorf("table still holds %d entries", n)
+	}
+}
+
+func TestUDPSessionReuse(t *testing.T) {
+	src := netip.MustParseAddrPort("10.0.0.2:5000")
+	dsts := []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:443"), netip.MustParseAddrPort("192.0.2.2:443")}
+	nop := func(*udpMapping, []byte, net.Addr) {}
+
+	for _, tt := range []struct {
+		mode  string
+		dials int32
+	}{
+		{NATSymmetric, 2},
+		{NATFullCone, 1},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			ob := &stubUDPOutbound{}
+			table := newUDPTable(0)
+			var sessions []*udpSession
+			for _, dst := range dsts {
+				s := &udpSession{key: udpKey{src, dst}, conn: nopUDPConn{}}
+				var mkey any = s.key
+				if tt.mode == NATFullCone {
+					mkey = fullConeKey{src, ob}
+				}
+				if err := table.open(context.Background(), s, mkey, ob, dst.String(), nop); err != nil {
+					t.Fatal(err)
+				}
+				sessions = append(sessions, s)
+			}
+			if n := ob.dials.Load(); n != tt.dials {
+				t.Errorf("dialed %d outbound sockets, want %d", n, tt.dials)
+			}
+			// Replies are matched to the session of their source.
+			for i, dst := range dsts {
+				if got := table.session(sessions[i].m, dst); got != sessions[i] {
+					t.Errorf("reply from %s went to %v", dst, got)
+				}
+			}
+			if got := table.session(sessions[0].m, netip.MustParseAddrPort("192.0.2.9:443")); got != nil {
+				t.Errorf("reply from an unknown host went to %v", got)
+			}
+
+			// A shared socket stays open until its last session closes.
+			table.close(sessions[0])
+			if closed := sessions[1].m.pc.(*stubPacketConn).isClosed(); closed {
+				t.Error("closing one session closed the socket of the other")
+			}
+			table.close(sessions[1])
+			for _, pc := range ob.pcs {
+				if !pc.isClosed() {
+					t.Error("outbound socket left open")
+				}
+			}
+			if n := len(table.sessions) + len(table.mappings); n != 0 {
+				t.Errorf("table still holds %d entries", n)
+			}
+		})
+	}
+}
+
+func TestUDPTableLimits(t *testing.T) {
+	ob := &stubUDPOutbound{}
+	table := newUDPTable(1)
+	nop := func(*udpMapping, []byte, net.Addr) {}
+	key := udpKey{netip.MustParseAddrPort("10.0.0.2:5000"), netip.MustParseAddrPort("192.0.2.1:53")}
+
+	s := &udpSession{key: key, conn: nopUDPConn{}}
+	if err := table.open(context.Background(), s, key, ob, key.dst.String(), nop); err != nil {
+		t.Fatal(err)
+	}
+	other := udpKey{key.src, netip.MustParseAddrPort("192.0.2.2:53")}
+	if err := table.open(context.Background(), &udpSession{key: other, conn: nopUDPConn{}}, other, ob, other.dst.String(), nop); err != errTooManySessions {
+		t.Errorf("got %v past the limit, want %v", err, errTooManySessions)
+	}
+	table.max = 0
+	if err := table.open(context.Background(), &udpSession{key: key, conn: nopUDPConn{}}, key, ob, key.dst.String(), nop); err == nil {
+		t.Error("a duplicate session was opened")
+	}
+	table.close(s)
+	if n := ob.dials.Load(); n != 1 {
+		t.Errorf("dialed %d outbound sockets, want 1", n)
+	}
+}
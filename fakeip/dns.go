@@ -0,0 +1,125 @@
+package fakeip
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answerTTL is kept short so clients come back to us instead of caching
+// an address that may be reassigned after eviction.
+const answerTTL = 1
+
+// ServeDNS answers a DNS query from the pool: A and AAAA queries for any
+// name, and PTR queries for pool addresses. It returns ok=false for every
+// other query, which should be forwarded to a real resolver.
+func (p *Pool) ServeDNS(query []byte) (resp []byte, ok bool) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil || header.Response {
+		return nil, false
+	}
+	q, err := parser.Question()
+	if err != nil || q.Class != dnsmessage.ClassINET {
+		return nil, false
+	}
+
+	var answer func(b *dnsmessage.Builder, h dnsmessage.ResourceHeader) error
+	switch q.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		v4, v6 := p.Lookup(q.Name.String())
+		if q.Type == dnsmessage.TypeA {
+			answer = func(b *dnsmessage.Builder, h dnsmessage.ResourceHeader) error {
+				return b.AResource(h, dnsmessage.AResource{A: v4.As4()})
+			}
+		} else if v6.IsValid() {
+			answer = func(b *dnsmessage.Builder, h dnsmessage.ResourceHeader) error {
+				return b.AAAAResource(h, dnsmessage.AAAAResource{AAAA: v6.As16()})
+			}
+		}
+	case dnsmessage.TypePTR:
+		ip, ok := parseReverse(q.Name.String())
+		if !ok {
+			return nil, false
+		}
+		name, ok := p.Name(ip)
+		if !ok {
+			return nil, false
+		}
+		ptr, err := dnsmessage.NewName(name + ".")
+		if err != nil {
+			return nil, false
+		}
+		answer = func(b *dnsmessage.Builder, h dnsmessage.ResourceHeader) error {
+			return b.PTRResource(h, dnsmessage.PTRResource{PTR: ptr})
+		}
+	default:
+		return nil, false
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, false
+	}
+	if err := b.Question(q); err != nil {
+		return nil, false
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, false
+	}
+	// AAAA without an IPv6 pool gets an empty answer so clients use IPv4.
+	if answer != nil {
+		h := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: answerTTL}
+		if err := answer(&b, h); err != nil {
+			return nil, false
+		}
+	}
+	resp, err = b.Finish()
+	return resp, err == nil
+}
+
+// parseReverse converts an in-addr.arpa or ip6.arpa name into an address.
+func parseReverse(name string) (netip.Addr, bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if v4, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		labels := strings.Split(v4, ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		var b [4]byte
+		for i, l := range labels {
+			n, err := strconv.ParseUint(l, 10, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			b[3-i] = byte(n)
+		}
+		return netip.AddrFrom4(b), true
+	}
+	if v6, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(v6, ".")
+		if len(nibbles) != 32 {
+			return netip.Addr{}, false
+		}
+		var b [16]byte
+		for i, l := range nibbles {
+			n, err := strconv.ParseUint(l, 16, 4)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			pos := 31 - i
+			b[pos/2] |= byte(n) << (4 * (1 - pos%2))
+		}
+		return netip.AddrFrom16(b), true
+	}
+	return netip.Addr{}, false
+}
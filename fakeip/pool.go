@@ -0,0 +1,255 @@
+// Package fakeip hands out addresses from a reserved range in answer to DNS
+// queries and remembers which name each address stands for, so that flows
+// to those addresses can be proxied by hostname.
+package fakeip
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultPrefix is the benchmarking range of RFC 2544, which is not used
+// on the public internet.
+var DefaultPrefix = netip.MustParsePrefix("198.18.0.0/15")
+
+// Pool maps names to fake addresses with least-recently-used eviction.
+// Both directions of the mapping are kept: name to address for DNS answers
+// and address to name for connections.
+type Pool struct {
+	mu      sync.Mutex
+	prefix4 netip.Prefix
+	prefix6 netip.Prefix
+	size    uint64
+	lru     *list.List // of *entry, most recently used at the front
+	byName  map[string]*list.Element
+	byIndex map[uint64]*list.Element
+	next    uint64
+}
+
+type entry struct {
+	Name  string `json:"name"`
+	Index uint64 `json:"index"`
+}
+
+// New creates a pool over prefix4 and, if valid, prefix6. The first and
+// last address of each prefix are never handed out. The same index is used
+// in both prefixes, so a name gets an IPv4 and an IPv6 address together.
+func New(prefix4, prefix6 netip.Prefix) (*Pool, error) {
+	if !prefix4.IsValid() || !prefix4.Addr().Is4() {
+		return nil, fmt.Errorf("fakeip: invalid IPv4 prefix %s", prefix4)
+	}
+	size := usable(prefix4)
+	if prefix6.IsValid() {
+		if !prefix6.Addr().Is6() {
+			return nil, fmt.Errorf("fakeip: invalid IPv6 prefix %s", prefix6)
+		}
+		if s := usable(prefix6); s < size {
+			size = s
+		}
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("fakeip: prefix %s is too small", prefix4)
+	}
+	return &Pool{
+		prefix4: prefix4.Masked(),
+		prefix6: prefix6.Masked(),
+		size:    size,
+		lru:     list.New(),
+		byName:  map[string]*list.Element{},
+		byIndex: map[uint64]*list.Element{},
+	}, nil
+}
+
+// usable returns the number of assignable addresses in p, capped so that
+// the index fits comfortably in a uint64.
+func usable(p netip.Prefix) uint64 {
+	hostBits := p.Addr().BitLen() - p.Bits()
+	if hostBits > 32 {
+		hostBits = 32
+	}
+	if hostBits < 2 {
+		return 0
+	}
+	return 1<<hostBits - 2
+}
+
+// Prefixes returns the IPv4 and IPv6 ranges of the pool; the IPv6 one is
+// invalid when the pool only serves IPv4.
+func (p *Pool) Prefixes() (netip.Prefix, netip.Prefix) {
+	return p.prefix4, p.prefix6
+}
+
+// Contains reports whether ip belongs to the pool.
+func (p *Pool) Contains(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return p.prefix4.Contains(ip) || (p.prefix6.IsValid() && p.prefix6.Contains(ip))
+}
+
+// Lookup returns the fake addresses of name, assigning them if needed.
+// The IPv6 address is invalid when the pool has no IPv6 prefix.
+func (p *Pool) Lookup(name string) (netip.Addr, netip.Addr) {
+	name = canonical(name)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if el, ok := p.byName[name]; ok {
+		p.lru.MoveToFront(el)
+		return p.addrs(el.Value.(*entry).Index)
+	}
+
+	var index uint64
+	if uint64(p.lru.Len()) < p.size {
+		// Skip indexes still held by entries restored from disk.
+		for {
+			index = p.next%p.size + 1
+			p.next++
+			if _, used := p.byIndex[index]; !used {
+				break
+			}
+		}
+	} else {
+		oldest := p.lru.Back()
+		old := oldest.Value.(*entry)
+		p.lru.Remove(oldest)
+		delete(p.byName, old.Name)
+		delete(p.byIndex, old.Index)
+		index = old.Index
+	}
+	p.insert(&entry{Name: name, Index: index})
+	return p.addrs(index)
+}
+
+// Name returns the name an address of the pool was handed out for.
+func (p *Pool) Name(ip netip.Addr) (string, bool) {
+	ip = ip.Unmap()
+	var index uint64
+	switch {
+	case p.prefix4.Contains(ip):
+		index = offset(p.prefix4, ip)
+	case p.prefix6.IsValid() && p.prefix6.Contains(ip):
+		index = offset(p.prefix6, ip)
+	default:
+		return "", false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	el, ok := p.byIndex[index]
+	if !ok {
+		return "", false
+	}
+	p.lru.MoveToFront(el)
+	return el.Value.(*entry).Name, true
+}
+
+func (p *Pool) insert(e *entry) {
+	el := p.lru.PushFront(e)
+	p.byName[e.Name] = el
+	p.byIndex[e.Index] = el
+}
+
+func (p *Pool) addrs(index uint64) (netip.Addr, netip.Addr) {
+	v4 := nth(p.prefix4, index)
+	var v6 netip.Addr
+	if p.prefix6.IsValid() {
+		v6 = nth(p.prefix6, index)
+	}
+	return v4, v6
+}
+
+// nth returns the address index positions after the start of p.
+func nth(p netip.Prefix, index uint64) netip.Addr {
+	n := new(big.Int).SetBytes(p.Addr().AsSlice())
+	n.Add(n, new(big.Int).SetUint64(index))
+	b := n.FillBytes(make([]byte, p.Addr().BitLen()/8))
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// offset is the inverse of nth.
+func offset(p netip.Prefix, ip netip.Addr) uint64 {
+	n := new(big.Int).SetBytes(ip.AsSlice())
+	n.Sub(n, new(big.Int).SetBytes(p.Addr().AsSlice()))
+	if !n.IsUint64() {
+		return 0
+	}
+	return n.Uint64()
+}
+
+func canonical(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// Save writes the mapping to path, most recently used first.
+func (p *Pool) Save(path string) error {
+	p.mu.Lock()
+	entries := make([]*entry, 0, p.lru.Len())
+	for el := p.lru.Front(); el != nil; el = el.Next() {
+		entries = append(entries, el.Value.(*entry))
+	}
+	p.mu.Unlock()
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	// Write a temporary file and rename it, so that a crash while saving
+	// leaves the previous mapping intact.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Load restores a mapping written by Save. A missing file is not an error;
+// entries that do not fit the current pool are skipped.
+func (p *Pool) Load(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []*entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return fmt.Errorf("fakeip: %s: %v", path, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Entries are stored most recent first, so push them in reverse.
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.Index == 0 || e.Index > p.size || uint64(p.lru.Len()) >= p.size {
+			continue
+		}
+		if _, ok := p.byName[e.Name]; ok {
+			continue
+		}
+		if _, ok := p.byIndex[e.Index]; ok {
+			continue
+		}
+		p.insert(&entry{Name: canonical(e.Name), Index: e.Index})
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package fakeip
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newPool(t *testing.T, prefix4, prefix6 string) *Pool {
+	t.Helper()
+	var p6 netip.Prefix
+	if prefix6 != "" {
+		p6 = netip.MustParsePrefix(prefix6)
+	}
+	p, err := New(netip.MustParsePrefix(prefix4), p6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		prefix4, prefix6 string
+		size             uint64
+		wantErr          bool
+	}{
+		{"198.18.0.0/15", "", 1<<17 - 2, false},
+		{"198.18.0.0/15", "fc00::/18", 1<<17 - 2, false},
+		// The smaller prefix bounds the pool, IPv6 host bits are capped at 32.
+		{"198.18.0.0/29", "fc00::/120", 6, false},
+		{"198.18.0.0/8", "fc00::/64", 1<<24 - 2, false},
+		{"198.18.0.0/31", "", 0, true},
+		{"fc00::/64", "", 0, true},
+		{"198.18.0.0/24", "198.19.0.0/24", 0, true},
+	}
+	for _, tt := range tests {
+		var p6 netip.Prefix
+		if tt.prefix6 != "" {
+			p6 = netip.MustParsePrefix(tt.prefix6)
+		}
+		p, err := New(netip.MustParsePrefix(tt.prefix4), p6)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("New(%s, %s): error %v, want error %v", tt.prefix4, tt.prefix6, err, tt.wantErr)
+			continue
+		}
+		if err == nil && p.size != tt.size {
+			t.Errorf("New(%s, %s): size %d, want %d", tt.prefix4, tt.prefix6, p.size, tt.size)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	p := newPool(t, "198.18.0.0/29", "fc00::/64")
+	v4, v6 := p.Lookup("Example.COM.")
+	if v4 != netip.MustParseAddr("198.18.0.1") || v6 != netip.MustParseAddr("fc00::1") {
+		t.Errorf("Lookup = %s, %s; want 198.18.0.1, fc00::1", v4, v6)
+	}
+	if again, _ := p.Lookup("example.com"); again != v4 {
+		t.Errorf("second Lookup = %s, want %s", again, v4)
+	}
+	for _, addr := range []netip.Addr{v4, v6, netip.MustParseAddr("::ffff:198.18.0.1")} {
+		if name, ok := p.Name(addr); !ok || name != "example.com" {
+			t.Errorf("Name(%s) = %q, %v; want example.com", addr, name, ok)
+		}
+	}
+	for _, addr := range []string{"198.18.0.2", "198.18.0.0", "192.0.2.1", "fd00::1"} {
+		if name, ok := p.Name(netip.MustParseAddr(addr)); ok {
+			t.Errorf("Name(%s) = %q, want none", addr, name)
+		}
+	}
+	if !p.Contains(netip.MustParseAddr("198.18.0.7")) || p.Contains(netip.MustParseAddr("198.18.0.8")) {
+		t.Error("Contains does not follow the prefix")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	// A /29 has six usable addresses, .1 to .6.
+	p := newPool(t, "198.18.0.0/29", "")
+	names := []string{"a", "b", "c", "d", "e", "f"}
+	for _, name := range names {
+		p.Lookup(name)
+	}
+	// Using a refreshes it, so b is now the least recently used.
+	p.Lookup("a")
+	if _, ok := p.Name(netip.MustParseAddr("198.18.0.1")); !ok {
+		t.Fatal("a missing")
+	}
+
+	g, _ := p.Lookup("g")
+	if g != netip.MustParseAddr("198.18.0.2") {
+		t.Errorf("g got %s, want b's 198.18.0.2", g)
+	}
+	if name, _ := p.Name(g); name != "g" {
+		t.Errorf("Name(%s) = %q, want g", g, name)
+	}
+	if _, ok := p.byName["b"]; ok {
+		t.Error("b still mapped after eviction")
+	}
+	// Name also counts as a use: c is looked up and d is evicted next.
+	p.Name(netip.MustParseAddr("198.18.0.3"))
+	if h, _ := p.Lookup("h"); h != netip.MustParseAddr("198.18.0.4") {
+		t.Errorf("h got %s, want d's 198.18.0.4", h)
+	}
+	if p.lru.Len() != 6 {
+		t.Errorf("pool holds %d entries, want 6", p.lru.Len())
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fakeip.json")
+	p := newPool(t, "198.18.0.0/29", "fc00::/64")
+	for _, name := range []string{"a", "b", "c"} {
+		p.Lookup(name)
+	}
+	p.Lookup("a")
+	if err := p.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("Save left %d files, want 1", len(entries))
+	}
+
+	q := newPool(t, "198.18.0.0/29", "fc00::/64")
+	if err := q.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		want4, want6 := p.Lookup(name)
+		if got, ok := q.Name(want4); !ok || got != name {
+			t.Errorf("Name(%s) = %q after Load, want %s", want4, got, name)
+		}
+		if got, ok := q.Name(want6); !ok || got != name {
+			t.Errorf("Name(%s) = %q after Load, want %s", want6, got, name)
+		}
+	}
+
+	// New names skip the restored indexes, wrapping around past the end.
+	q.next = 4
+	var got []netip.Addr
+	for _, name := range []string{"d", "e", "f"} {
+		v4, _ := q.Lookup(name)
+		got = append(got, v4)
+	}
+	want := []string{"198.18.0.5", "198.18.0.6", "198.18.0.4"}
+	for i := range want {
+		if got[i] != netip.MustParseAddr(want[i]) {
+			t.Errorf("new names got %v, want %v", got, want)
+			break
+		}
+	}
+
+	// The LRU order is restored too: b is the oldest and goes first.
+	q.Lookup("b")
+	q.Lookup("c")
+	q.Lookup("a")
+	if v4, _ := q.Lookup("g"); v4 != netip.MustParseAddr("198.18.0.5") {
+		t.Errorf("g got %s, want the evicted d's 198.18.0.5", v4)
+	}
+}
+
+func TestLoadSkips(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fakeip.json")
+	// Index 0 and indexes past a /30 do not fit, duplicates are dropped.
+	data := `[{"name":"A","index":1},{"name":"zero","index":0},{"name":"big","index":7},` +
+		`{"name":"dup-index","index":1},{"name":"a","index":2},{"name":"b","index":2}]`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := newPool(t, "198.18.0.0/30", "")
+	if err := p.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"198.18.0.1": "dup-index", "198.18.0.2": "b"}
+	for addr, name := range want {
+		if got, _ := p.Name(netip.MustParseAddr(addr)); got != name {
+			t.Errorf("Name(%s) = %q, want %q", addr, got, name)
+		}
+	}
+	if p.lru.Len() != 2 {
+		t.Errorf("loaded %d entries, want 2", p.lru.Len())
+	}
+
+	if err := p.Load(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("Load of a missing file: %v", err)
+	}
+	os.WriteFile(path, []byte("{"), 0o600)
+	if err := p.Load(path); err == nil {
+		t.Error("Load accepted a malformed file")
+	}
+}
+
+func TestParseReverse(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"1.0.18.198.in-addr.arpa.", "198.18.0.1"},
+		{"255.255.19.198.IN-ADDR.ARPA", "198.19.255.255"},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.c.f.ip6.arpa.", "fc00::1"},
+		{"B.A.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", "2001:db8::ab"},
+		{"0.18.198.in-addr.arpa.", ""},
+		{"1.1.0.18.198.in-addr.arpa.", ""},
+		{"256.0.18.198.in-addr.arpa.", ""},
+		{"x.0.18.198.in-addr.arpa.", ""},
+		{"1.0.0.0.c.f.ip6.arpa.", ""},
+		{"g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.c.f.ip6.arpa.", ""},
+		{"10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.c.f.ip6.arpa.", ""},
+		{"example.com.", ""},
+	}
+	for _, tt := range tests {
+		got, ok := parseReverse(tt.name)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("parseReverse(%s) = %s, want none", tt.name, got)
+			}
+			continue
+		}
+		if !ok || got != netip.MustParseAddr(tt.want) {
+			t.Errorf("parseReverse(%s) = %s, %v; want %s", tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func TestServeDNS(t *testing.T) {
+	p := newPool(t, "198.18.0.0/15", "")
+	query := func(name string, typ dnsmessage.Type) *dnsmessage.Message {
+		t.Helper()
+		q := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: 7, RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}},
+		}
+		b, _ := q.Pack()
+		resp, ok := p.ServeDNS(b)
+		if !ok {
+			return nil
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(resp); err != nil {
+			t.Fatal(err)
+		}
+		return &msg
+	}
+
+	a := query("example.com.", dnsmessage.TypeA)
+	if a == nil || a.ID != 7 || len(a.Answers) != 1 {
+		t.Fatalf("A answer = %+v", a)
+	}
+	if got := a.Answers[0].Body.(*dnsmessage.AResource).A; got != [4]byte{198, 18, 0, 1} {
+		t.Errorf("A = %v, want 198.18.0.1", got)
+	}
+	// Without an IPv6 range AAAA is answered empty, not forwarded.
+	if aaaa := query("example.com.", dnsmessage.TypeAAAA); aaaa == nil || len(aaaa.Answers) != 0 {
+		t.Errorf("AAAA answer = %+v, want an empty answer", aaaa)
+	}
+
+	ptr := query("1.0.18.198.in-addr.arpa.", dnsmessage.TypePTR)
+	if ptr == nil || len(ptr.Answers) != 1 {
+		t.Fatalf("PTR answer = %+v", ptr)
+	}
+	if got := ptr.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String(); got != "example.com." {
+		t.Errorf("PTR = %s, want example.com.", got)
+	}
+	// Unassigned and foreign addresses, and other types, go upstream.
+	for _, tt := range []struct {
+		name string
+		typ  dnsmessage.Type
+	}{
+		{"2.0.18.198.in-addr.arpa.", dnsmessage.TypePTR},
+		{"1.2.0.192.in-addr.arpa.", dnsmessage.TypePTR},
+		{"example.com.", dnsmessage.TypeMX},
+	} {
+		if msg := query(tt.name, tt.typ); msg != nil {
+			t.Errorf("%s %v answered locally: %+v", tt.name, tt.typ, msg)
+		}
+	}
+}
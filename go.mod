@@ -7,6 +7,7 @@ toolchain go1.22.2
 require (
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
 	golang.org/x/crypto v0.24.0
+	golang.org/x/net v0.25.0
 	golang.org/x/sys v0.26.0
 	golang.zx2c4.com/wireguard v0.0.0-20231211153847-12269c276173
 	golang.zx2c4.com/wireguard/windows v0.5.3
@@ -15,7 +16,6 @@ require (
 
 require (
 	github.com/google/btree v1.1.2 // indirect
-	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/text v0.16.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
 	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
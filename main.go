@@ -3,35 +3,330 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/yimiaoxiehou/tun2socks/core"
+	"github.com/yimiaoxiehou/tun2socks/fakeip"
+	"github.com/yimiaoxiehou/tun2socks/proxy"
+	"github.com/yimiaoxiehou/tun2socks/resolver"
+	"github.com/yimiaoxiehou/tun2socks/rule"
+	"github.com/yimiaoxiehou/tun2socks/tun"
 )
 
+// listFlag collects every occurrence of a repeatable flag.
+type listFlag []string
+
+func (l *listFlag) String() string     { return strings.Join(*l, " ") }
+func (l *listFlag) Set(s string) error { *l = append(*l, s); return nil }
+
 var tunDevice = flag.String("dev", "demo-tun", "tunDevice name")
-var tunAddr = flag.String("addr", "10.10.10.10", "tunAddr 10.10.10.10")
+var tunAddr = flag.String("addr", "10.10.10.10", "tunAddr 10.10.10.10, or comma-separated IPv4 and IPv6 addresses with optional prefix lengths, e.g. 10.10.10.10,fd00::10/64")
 var netmask = flag.String("mask", "255.255.255.255", "mask 255.255.255.255")
 var mtu = flag.Int("mtu", 1420, "mtu 1420")
-var socksAddr = flag.String("proxy", "socks5://192.168.44.213:1080", "socksAddr")
-var routers = flag.String("routers", "10.10.10.0/24", "routers router1,router2,router3")
+var proxyURL = flag.String("proxy", "socks5://192.168.44.213:1080", "proxy url socks5://host:port, socks4(a)://host:port, http(s)://host:port, ss://, direct://, or an -outbound/-group name")
+var routers = flag.String("routers", "10.10.10.0/24", "routers router1,router2,router3, IPv4 or IPv6 prefixes")
+var stateFile = flag.String("state-file", "", "file recording the installed addresses and routes, so those left by a crash are removed at the next start (default /run/tun2socks/<dev>.state on Linux, /var/run/tun2socks/<dev>.state on macOS); set to empty to disable")
+var autoRoute = flag.Bool("auto-route", false, "route all traffic through the TUN (Linux), keeping the proxy and DNS servers on the current default gateway")
+var routeTable = flag.Int("table", 0, "Linux policy routing: install routes in this table instead of main, selected by rules that skip packets carrying -mark (0x2022 unless set)")
+var rulePriority = flag.Int("rule-priority", 0, "priority of the -table rules (default 9000)")
+var cgroup = flag.String("cgroup", "", "Linux: only proxy processes in this cgroup v2 path, e.g. tun2socks; start them with 'tun2socks exec -cgroup <path> -- cmd'")
+var cgroupMark = flag.Int("cgroup-mark", 0, "fwmark given to packets of the -cgroup processes (default 0x2023)")
+var socketMark = flag.Int("mark", 0, "SO_MARK for outgoing sockets (Linux), so policy routing can keep them off the TUN")
+var bindInterface = flag.String("interface", "", "bind outgoing sockets to this interface (SO_BINDTODEVICE on Linux, IP_BOUND_IF on macOS)")
+var sourceAddr = flag.String("source", "", "local address for outgoing sockets")
+var rulesFile = flag.String("rules", "", "rules file choosing proxy:<name>, direct or reject per destination")
+var fakeIPRange = flag.String("fakeip", "", "answer DNS with fake addresses from this range, e.g. 198.18.0.0/15, and proxy by hostname")
+var fakeIPRange6 = flag.String("fakeip6", "", "optional IPv6 range for fake AAAA answers, e.g. fc00::/18")
+var fakeIPFile = flag.String("fakeip-file", "", "file keeping the fake-ip mapping across restarts")
+var sniffDomain = flag.Bool("sniff", false, "recover hostnames from TLS SNI and HTTP Host of TCP flows and QUIC Initial SNI of UDP flows")
+var sniffTimeout = flag.Duration("sniff-timeout", 300*time.Millisecond, "how long to wait for the first client bytes when sniffing")
+var dnsCacheSize = flag.Int("dns-cache", 4096, "number of DNS responses to cache, 0 disables the cache; on Unix SIGUSR1 logs cache stats, SIGHUP flushes it")
+var dnsMinTTL = flag.Duration("dns-min-ttl", 0, "lower bound for cached DNS TTLs")
+var dnsMaxTTL = flag.Duration("dns-max-ttl", 24*time.Hour, "upper bound for cached DNS TTLs")
+var dnsUpstreams = flag.String("dns", "udp://127.0.0.1:53", "upstreams for intercepted DNS, comma-separated udp://, tcp://, tls:// (DoT) or https:// (DoH) URLs, ?timeout=3s per upstream, ?via=proxy or ?via=<name> to tunnel tcp/tls/https through an outbound")
+var hostsFile = flag.String("hosts", "", "hosts file with static DNS answers")
+var blockFile = flag.String("dns-block", "", "file of blocked domains, one per line, answered per -dns-block-mode")
+var blockMode = flag.String("dns-block-mode", "nxdomain", "answer for blocked domains: nxdomain or zero (0.0.0.0 and ::)")
+var routeDomains = flag.String("route-domains", "", "comma-separated domain suffixes (*.corp.example) whose DNS answers get host routes via the TUN device until they expire")
+var udpTimeout = flag.Duration("udp-timeout", 60*time.Second, "close UDP sessions idle for this long")
+var udpPortTimeouts = flag.String("udp-port-timeout", "", "comma-separated per destination port idle timeouts, port=duration, added to the default 53=10s")
+var udpNAT = flag.String("udp-nat", "symmetric", "UDP mapping: symmetric, or full-cone to share one outbound socket per client port and accept replies from any host")
+var udpMaxSessions = flag.Int("udp-max-sessions", 4096, "maximum number of relayed UDP sessions, 0 for no limit")
+var dnsZones listFlag
+var outbounds listFlag
+var groups listFlag
+var probeTarget = flag.String("probe-target", "", "host:port dialed through group members as health check, default probes the proxy server itself")
+var probeInterval = flag.Duration("probe-interval", 30*time.Second, "group health check interval")
+
+// watchCache handles the signals controlling the DNS cache, where the
+// platform has them.
+var watchCache func(cache *resolver.Cache)
+
+func init() {
+	flag.Var(&dnsZones, "dns-zone", "resolve a domain suffix through other upstreams, suffix=url1,url2, repeatable")
+	flag.Var(&outbounds, "outbound", "named outbound name=url, repeatable")
+	flag.Var(&groups, "group", "proxy group name=strategy:member1,member2 with strategy round-robin, least-conn, consistent-hash or failover, repeatable")
+}
+
+// buildOutbounds creates the named outbounds and groups given on the command line.
+func buildOutbounds() (map[string]proxy.Outbound, error) {
+	named := map[string]proxy.Outbound{}
+	for _, o := range outbounds {
+		name, rawURL, ok := strings.Cut(o, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -outbound %q, want name=url", o)
+		}
+		ob, err := proxy.New(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("outbound %s: %v", name, err)
+		}
+		named[name] = ob
+	}
+	for _, g := range groups {
+		name, spec, ok := strings.Cut(g, "=")
+		strategy, list, ok2 := strings.Cut(spec, ":")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid -group %q, want name=strategy:member1,member2", g)
+		}
+		var members []proxy.Outbound
+		names := strings.Split(list, ",")
+		for _, m := range names {
+			ob, ok := named[m]
+			if !ok {
+				return nil, fmt.Errorf("group %s: unknown outbound %q", name, m)
+			}
+			members = append(members, ob)
+		}
+		group, err := proxy.NewGroup(name, names, members, proxy.GroupOptions{
+			Strategy:      strategy,
+			ProbeTarget:   *probeTarget,
+			ProbeInterval: *probeInterval,
+		})
+		if err != nil {
+			return nil, err
+		}
+		named[name] = group
+	}
+	return named, nil
+}
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "exec" {
+		os.Exit(runExec(os.Args[2:]))
+	}
 	flag.Parse()
+	if !flagSet("state-file") {
+		*stateFile = defaultStateFile(*tunDevice)
+	}
+
+	// Groups probe their members as soon as they are built, so the socket
+	// options must already be in place.
+	socket := &proxy.SocketOptions{Mark: *socketMark, Interface: *bindInterface}
+	if *sourceAddr != "" {
+		var err error
+		if socket.Source, err = netip.ParseAddr(*sourceAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	proxy.SetSocketOptions(*socket)
+
+	named, err := buildOutbounds()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var rules *rule.Set
+	if *rulesFile != "" {
+		if rules, err = rule.Load(*rulesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var pool *fakeip.Pool
+	if *fakeIPRange != "" {
+		prefix4, err := netip.ParsePrefix(*fakeIPRange)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var prefix6 netip.Prefix
+		if *fakeIPRange6 != "" {
+			if prefix6, err = netip.ParsePrefix(*fakeIPRange6); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if pool, err = fakeip.New(prefix4, prefix6); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	zones := map[string]string{}
+	for _, z := range dnsZones {
+		suffix, upstreams, ok := strings.Cut(z, "=")
+		if !ok || suffix == "" || upstreams == "" {
+			log.Fatalf("invalid -dns-zone %q, want suffix=url1,url2", z)
+		}
+		zones[suffix] = upstreams
+	}
+	var hosts *resolver.Hosts
+	if *hostsFile != "" {
+		if hosts, err = resolver.LoadHosts(*hostsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var block *resolver.Blocklist
+	if *blockFile != "" {
+		if *blockMode != "nxdomain" && *blockMode != "zero" {
+			log.Fatalf("invalid -dns-block-mode %q, want nxdomain or zero", *blockMode)
+		}
+		if block, err = resolver.LoadBlocklist(*blockFile, *blockMode == "zero"); err != nil {
+			log.Fatal(err)
+		}
+	}
+	portTimeouts := map[uint16]time.Duration{}
+	for _, pt := range splitList(*udpPortTimeouts) {
+		port, timeout, ok := strings.Cut(pt, "=")
+		p, err := strconv.ParseUint(port, 10, 16)
+		d, derr := time.ParseDuration(timeout)
+		if !ok || err != nil || derr != nil {
+			log.Fatalf("invalid -udp-port-timeout %q, want port=duration", pt)
+		}
+		portTimeouts[uint16(p)] = d
+	}
+
+	var cache *resolver.Cache
+	if *dnsCacheSize > 0 {
+		cache = resolver.NewCache(*dnsCacheSize, *dnsMinTTL, *dnsMaxTTL)
+		if watchCache != nil {
+			go watchCache(cache)
+		}
+	}
 
 	e := &core.Engine{
-		TunDevice: *tunDevice,
-		TunAddr:   *tunAddr,
-		TunMask:   *netmask,
-		Mtu:       *mtu,
-		Sock5Addr: *socksAddr,
-		Routers:   strings.Split(*routers, ","),
+		TunDevice:    *tunDevice,
+		TunAddr:      *tunAddr,
+		TunMask:      *netmask,
+		Mtu:          *mtu,
+		Proxy:        *proxyURL,
+		Routers:      strings.Split(*routers, ","),
+		Outbound:     named[*proxyURL],
+		Socket:       socket,
+		AutoRoute:    *autoRoute,
+		StateFile:    *stateFile,
+		RouteTable:   *routeTable,
+		RulePriority: *rulePriority,
+		Cgroup:       *cgroup,
+		CgroupMark:   *cgroupMark,
+		Rules:        rules,
+		Outbounds:    named,
+		FakeIP:       pool,
+		FakeIPFile:   *fakeIPFile,
+		DNS:          *dnsUpstreams,
+		DNSZones:     zones,
+		DNSHosts:     hosts,
+		DNSBlock:     block,
+		DNSCache:     cache,
+		RouteDomains: splitList(*routeDomains),
+		Sniff:        *sniffDomain,
+		SniffTimeout: *sniffTimeout,
+
+		UDPTimeout:      *udpTimeout,
+		UDPPortTimeouts: portTimeouts,
+		UDPNAT:          *udpNAT,
+		MaxUDPSessions:  *udpMaxSessions,
+	}
+	if err := e.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Stop removes the installed addresses, routes and rules and saves the
+	// fake-ip mapping, so run it before exiting.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	log.Printf("Received %v, stopping", <-sig)
+	if err := e.Stop(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// defaultStateFile returns the per-device state file under the root-only
+// runtime directory, or "" where there is none.
+func defaultStateFile(dev string) string {
+	switch runtime.GOOS {
+	case "linux":
+		return filepath.Join("/run/tun2socks", dev+".state")
+	case "darwin":
+		return filepath.Join("/var/run/tun2socks", dev+".state")
 	}
+	return ""
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// runExec implements "tun2socks exec [-cgroup path] -- cmd [args...]": it
+// moves itself into the cgroup, creating it if needed, and runs cmd there,
+// exiting with its status.
+func runExec(args []string) int {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	path := fs.String("cgroup", "tun2socks", "cgroup v2 path to run the command in")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: tun2socks exec [-cgroup path] -- command [args...]")
+		return 2
+	}
+	if err := tun.JoinCgroup(*path); err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	cmd := exec.Command(fs.Arg(0), fs.Args()[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		log.Print(err)
+		return 1
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		err := e.Start()
-		if err != nil {
-			fmt.Println(err)
+		for s := range sig {
+			cmd.Process.Signal(s)
 		}
 	}()
-	time.Sleep(1000 * time.Second)
+	if err := cmd.Wait(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			return exit.ExitCode()
+		}
+		log.Print(err)
+		return 1
+	}
+	return 0
 }
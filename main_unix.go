@@ -0,0 +1,33 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/yimiaoxiehou/tun2socks/resolver"
+)
+
+func init() {
+	watchCache = watchCacheSignals
+}
+
+// watchCacheSignals logs the DNS cache stats on SIGUSR1 and flushes the
+// cache on SIGHUP.
+func watchCacheSignals(cache *resolver.Cache) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGHUP)
+	for s := range sig {
+		if s == syscall.SIGHUP {
+			cache.Flush()
+			log.Print("DNS cache flushed")
+			continue
+		}
+		st := cache.Stats()
+		log.Printf("DNS cache: %d entries, %d hits, %d misses, %d prefetches, %d evictions",
+			st.Size, st.Hits, st.Misses, st.Prefetches, st.Evictions)
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// HopError reports which hop of a proxy chain failed.
+type HopError struct {
+	Hop int    // 1-based position in the chain
+	URL string // hop URL with the password redacted
+	Err error
+
+	last bool // the hop reaching the destination rather than the next hop
+}
+
+func (e *HopError) Error() string {
+	return fmt.Sprintf("proxy chain hop %d (%s): %v", e.Hop, e.URL, e.Err)
+}
+
+func (e *HopError) Unwrap() error {
+	return e.Err
+}
+
+// Chain reaches destinations through several proxies in order: the first
+// hop is dialed directly and every later hop is dialed through the tunnel
+// of the one before it. Each hop authenticates on its own.
+type Chain struct {
+	hops []*hop
+}
+
+// hop labels the errors of one outbound in the chain.
+type hop struct {
+	index int
+	url   string
+	last  bool
+	Outbound
+}
+
+func (h *hop) wrap(err error) error {
+	var hopErr *HopError
+	if err == nil || errors.As(err, &hopErr) {
+		return err
+	}
+	return &HopError{Hop: h.index, URL: h.url, Err: err, last: h.last}
+}
+
+func (h *hop) DialTCP(ctx context.Context, dst string) (net.Conn, error) {
+	conn, err := h.Outbound.DialTCP(ctx, dst)
+	return conn, h.wrap(err)
+}
+
+// DialContext lets the next hop use this one as its forward dialer.
+func (h *hop) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, h.wrap(fmt.Errorf("dial %s %s: %w", network, address, ErrUnsupported))
+	}
+	return h.DialTCP(ctx, address)
+}
+
+// NewChain builds a chain from hop URLs, outermost proxy first.
+func NewChain(forward Dialer, rawURLs ...string) (*Chain, error) {
+	if len(rawURLs) == 0 {
+		return nil, errors.New("proxy: empty chain")
+	}
+	c := &Chain{}
+	for i, raw := range rawURLs {
+		u, err := parseURL(raw)
+		if err != nil {
+			return nil, fmt.Errorf("proxy chain hop %d: %v", i+1, err)
+		}
+		ob, err := FromURL(u, forward)
+		if err != nil {
+			return nil, &HopError{Hop: i + 1, URL: u.Redacted(), Err: err}
+		}
+		h := &hop{index: i + 1, url: u.Redacted(), Outbound: ob}
+		c.hops = append(c.hops, h)
+		forward = h
+	}
+	c.hops[len(c.hops)-1].last = true
+	return c, nil
+}
+
+func (c *Chain) DialTCP(ctx context.Context, dst string) (net.Conn, error) {
+	return c.hops[len(c.hops)-1].DialTCP(ctx, dst)
+}
+
+// DialUDP only works for a single hop: datagrams cannot be carried through
+// the TCP tunnels of the earlier hops.
+func (c *Chain) DialUDP(ctx context.Context, dst string) (net.PacketConn, error) {
+	last := c.hops[len(c.hops)-1]
+	if len(c.hops) > 1 {
+		return nil, last.wrap(fmt.Errorf("udp to %s: %w", dst, ErrUnsupported))
+	}
+	pc, err := last.DialUDP(ctx, dst)
+	return pc, last.wrap(err)
+}
+
+// Probe checks the last hop, which reaches its server through all the
+// hops before it.
+func (c *Chain) Probe(ctx context.Context) error {
+	last := c.hops[len(c.hops)-1]
+	if p, ok := last.Outbound.(Prober); ok {
+		return last.wrap(p.Probe(ctx))
+	}
+	return nil
+}
+
+// Servers returns the servers of the first hop, the only one dialed over
+// the network.
+func (c *Chain) Servers() []string {
+	return Servers(c.hops[0].Outbound)
+}
+
+// parseURL parses an outbound URL, treating a bare "host:port" as SOCKS5.
+func parseURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "socks5://" + rawURL
+	}
+	return url.Parse(rawURL)
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+func init() {
+	Register("direct", func(u *url.URL, forward Dialer) (Outbound, error) {
+		d := &Direct{forward: forward}
+		opts, ok, err := parseSocketOptions(u.Query())
+		if err != nil {
+			return nil, fmt.Errorf("direct: %v", err)
+		}
+		if ok {
+			d.sys = &systemDialer{opts: &opts}
+			d.forward = d.sys
+		}
+		return d, nil
+	})
+}
+
+// Direct connects to destinations without any proxy. With
+// direct://?mark=1&interface=eth0&source=192.0.2.1 its sockets get these
+// options in place of the same ones of SetSocketOptions, keeping the rest
+// such as Protect.
+type Direct struct {
+	forward Dialer
+	sys     *systemDialer
+}
+
+func (d *Direct) DialTCP(ctx context.Context, dst string) (net.Conn, error) {
+	return d.forward.DialContext(ctx, "tcp", dst)
+}
+
+func (d *Direct) DialUDP(ctx context.Context, dst string) (net.PacketConn, error) {
+	var pc net.PacketConn
+	var err error
+	if d.sys != nil {
+		pc, err = d.sys.ListenUDP(ctx)
+	} else {
+		pc, err = listenUDP(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &directPacketConn{PacketConn: pc}, nil
+}
+
+// directPacketConn resolves destinations that are not already *net.UDPAddr,
+// such as domain addresses, before sending.
+type directPacketConn struct {
+	net.PacketConn
+}
+
+func (c *directPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if _, ok := addr.(*net.UDPAddr); !ok {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			return 0, err
+		}
+		addr = udpAddr
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
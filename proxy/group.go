@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yimiaoxiehou/tun2socks/socks"
+)
+
+// Group strategies.
+const (
+	RoundRobin     = "round-robin"
+	LeastConn      = "least-conn"
+	ConsistentHash = "consistent-hash"
+	Failover       = "failover"
+)
+
+// Prober is implemented by outbounds that can check their server without
+// opening a flow, e.g. by completing the SOCKS handshake.
+type Prober interface {
+	Probe(ctx context.Context) error
+}
+
+// GroupOptions configures health checking of a Group.
+type GroupOptions struct {
+	Strategy string
+	// ProbeTarget is dialed through each member as a health check. When
+	// empty, members implementing Prober are probed instead.
+	ProbeTarget   string
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+	// MaxFails consecutive dial failures mark a member unhealthy until the
+	// next successful probe.
+	MaxFails int
+}
+
+// Group spreads flows over several outbounds and takes unhealthy members
+// out of rotation until they recover.
+type Group struct {
+	name    string
+	opts    GroupOptions
+	members []*member
+	ring    []ringNode
+	next    atomic.Uint32
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+type member struct {
+	name    string
+	ob      Outbound
+	healthy atomic.Bool
+	fails   atomic.Int32
+	conns   atomic.Int64
+}
+
+type ringNode struct {
+	hash   uint32
+	member *member
+}
+
+// ringReplicas is the number of virtual nodes per member on the hash ring.
+const ringReplicas = 64
+
+// NewGroup creates a group over members, keyed by name, and starts its
+// health checks. Close stops them.
+func NewGroup(name string, names []string, members []Outbound, opts GroupOptions) (*Group, error) {
+	if len(members) == 0 || len(names) != len(members) {
+		return nil, fmt.Errorf("proxy group %s: no members", name)
+	}
+	switch opts.Strategy {
+	case "":
+		opts.Strategy = RoundRobin
+	case RoundRobin, LeastConn, ConsistentHash, Failover:
+	default:
+		return nil, fmt.Errorf("proxy group %s: unknown strategy %q", name, opts.Strategy)
+	}
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = 30 * time.Second
+	}
+	if opts.ProbeTimeout <= 0 {
+		opts.ProbeTimeout = 5 * time.Second
+	}
+	if opts.MaxFails <= 0 {
+		opts.MaxFails = 3
+	}
+
+	g := &Group{name: name, opts: opts, stop: make(chan struct{}), done: make(chan struct{})}
+	for i, ob := range members {
+		m := &member{name: names[i], ob: ob}
+		m.healthy.Store(true)
+		g.members = append(g.members, m)
+		for r := 0; r < ringReplicas; r++ {
+			h := crc32.ChecksumIEEE([]byte(m.name + "#" + strconv.Itoa(r)))
+			g.ring = append(g.ring, ringNode{hash: h, member: m})
+		}
+	}
+	sort.Slice(g.ring, func(i, j int) bool { return g.ring[i].hash < g.ring[j].hash })
+
+	go g.healthCheck()
+	return g, nil
+}
+
+// Servers returns the servers of every member.
+func (g *Group) Servers() []string {
+	var servers []string
+	for _, m := range g.members {
+		servers = append(servers, Servers(m.ob)...)
+	}
+	return servers
+}
+
+// Close stops the health checks, waiting for a running round of probes.
+func (g *Group) Close() error {
+	g.once.Do(func() { close(g.stop) })
+	<-g.done
+	return nil
+}
+
+func (g *Group) healthCheck() {
+	defer close(g.done)
+	ticker := time.NewTicker(g.opts.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		g.probeAll()
+		select {
+		case <-ticker.C:
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+func (g *Group) probeAll() {
+	var wg sync.WaitGroup
+	for _, m := range g.members {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), g.opts.ProbeTimeout)
+			defer cancel()
+			err := g.probe(ctx, m)
+			if err == nil {
+				m.fails.Store(0)
+				if !m.healthy.Swap(true) {
+					log.Printf("proxy group %s: %s recovered", g.name, m.name)
+				}
+			} else if m.healthy.Swap(false) {
+				log.Printf("proxy group %s: %s unhealthy: %v", g.name, m.name, err)
+			}
+		}(m)
+	}
+	wg.Wait()
+}
+
+// probe checks m with a CONNECT to the probe target, or its own Probe.
+// Members that cannot be probed are given another chance every interval.
+func (g *Group) probe(ctx context.Context, m *member) error {
+	if g.opts.ProbeTarget != "" {
+		conn, err := m.ob.DialTCP(ctx, g.opts.ProbeTarget)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	if p, ok := m.ob.(Prober); ok {
+		return p.Probe(ctx)
+	}
+	return nil
+}
+
+// pick selects the member for dst according to the strategy among those
+// not tried yet, considering only healthy members unless none are left.
+// It returns nil once every member has been tried.
+func (g *Group) pick(dst string, tried []*member) *member {
+	var untried, candidates []*member
+	for _, m := range g.members {
+		if slices.Contains(tried, m) {
+			continue
+		}
+		untried = append(untried, m)
+		if m.healthy.Load() {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = untried
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch g.opts.Strategy {
+	case Failover:
+		return candidates[0]
+	case LeastConn:
+		best := candidates[0]
+		for _, m := range candidates[1:] {
+			if m.conns.Load() < best.conns.Load() {
+				best = m
+			}
+		}
+		return best
+	case ConsistentHash:
+		host, _, err := net.SplitHostPort(dst)
+		if err != nil {
+			host = dst
+		}
+		h := crc32.ChecksumIEEE([]byte(host))
+		i := sort.Search(len(g.ring), func(i int) bool { return g.ring[i].hash >= h })
+		for n := 0; n < len(g.ring); n++ {
+			node := g.ring[(i+n)%len(g.ring)]
+			if slices.Contains(candidates, node.member) {
+				return node.member
+			}
+		}
+		return candidates[0]
+	default:
+		return candidates[(g.next.Add(1)-1)%uint32(len(candidates))]
+	}
+}
+
+// report counts consecutive dial failures of m.
+func (g *Group) report(m *member, err error) {
+	if err == nil {
+		m.fails.Store(0)
+		return
+	}
+	if m.fails.Add(1) >= int32(g.opts.MaxFails) && m.healthy.Swap(false) {
+		log.Printf("proxy group %s: %s unhealthy after %d failures: %v", g.name, m.name, g.opts.MaxFails, err)
+	}
+}
+
+// dial calls dial with the members in the order of the strategy until one
+// succeeds. A failure of the member itself counts towards MaxFails and
+// moves on to the next member; an error a working proxy reports about the
+// destination is returned right away, as other members would fail alike.
+func (g *Group) dial(ctx context.Context, dst string, dial func(m *member) error) error {
+	var tried []*member
+	var err error
+	for m := g.pick(dst, nil); m != nil; m = g.pick(dst, tried) {
+		tried = append(tried, m)
+		merr := dial(m)
+		if merr == nil {
+			g.report(m, nil)
+			m.conns.Add(1)
+			return nil
+		}
+		err = fmt.Errorf("proxy group %s: %s: %w", g.name, m.name, merr)
+		if destinationError(merr) {
+			g.report(m, nil)
+			return err
+		}
+		// A member without UDP support is not failing.
+		if !errors.Is(merr, ErrUnsupported) {
+			g.report(m, merr)
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// destinationError reports whether err is a proxy's answer that it could
+// not reach the destination, as opposed to a transport or handshake failure
+// of the proxy itself.
+func destinationError(err error) bool {
+	var hopErr *HopError
+	if errors.As(err, &hopErr) && !hopErr.last {
+		// An inner hop failed to reach the next proxy of the chain.
+		return false
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusForbidden, http.StatusNotFound, http.StatusBadGateway, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	for _, target := range []error{
+		socks.ErrConnectionNotAllowed,
+		socks.ErrNetworkUnreachable,
+		socks.ErrHostUnreachable,
+		socks.ErrConnectionRefused,
+		socks.ErrTTLExpired,
+		socks.ErrSocks4Rejected,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Group) DialTCP(ctx context.Context, dst string) (net.Conn, error) {
+	var conn net.Conn
+	var m *member
+	err := g.dial(ctx, dst, func(cand *member) (err error) {
+		conn, err = cand.ob.DialTCP(ctx, dst)
+		m = cand
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &countedConn{Conn: conn, m: m}, nil
+}
+
+func (g *Group) DialUDP(ctx context.Context, dst string) (net.PacketConn, error) {
+	var pc net.PacketConn
+	var m *member
+	err := g.dial(ctx, dst, func(cand *member) (err error) {
+		pc, err = cand.ob.DialUDP(ctx, dst)
+		m = cand
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &countedPacketConn{PacketConn: pc, m: m}, nil
+}
+
+// countedConn releases its member's connection count once on Close.
+type countedConn struct {
+	net.Conn
+	m    *member
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.m.conns.Add(-1) })
+	return c.Conn.Close()
+}
+
+type countedPacketConn struct {
+	net.PacketConn
+	m    *member
+	once sync.Once
+}
+
+func (c *countedPacketConn) Close() error {
+	c.once.Do(func() { c.m.conns.Add(-1) })
+	return c.PacketConn.Close()
+}
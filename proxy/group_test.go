@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/yimiaoxiehou/tun2socks/socks"
+)
+
+// stubOutbound records the dials made through it and fails them with
+// dialErr; Probe returns probeErr.
+type stubOutbound struct {
+	name     string
+	dialErr  error
+	probeErr error
+	dialed   *[]string
+}
+
+type stubConn struct{ net.Conn }
+
+func (stubConn) Close() error { return nil }
+
+type stubPacketConn struct{ net.PacketConn }
+
+func (stubPacketConn) Close() error { return nil }
+
+func (s *stubOutbound) DialTCP(ctx context.Context, dst string) (net.Conn, error) {
+	*s.dialed = append(*s.dialed, s.name)
+	if s.dialErr != nil {
+		return nil, s.dialErr
+	}
+	return stubConn{}, nil
+}
+
+func (s *stubOutbound) DialUDP(ctx context.Context, dst string) (net.PacketConn, error) {
+	*s.dialed = append(*s.dialed, s.name)
+	if s.dialErr != nil {
+		return nil, s.dialErr
+	}
+	return stubPacketConn{}, nil
+}
+
+func (s *stubOutbound) Probe(ctx context.Context) error { return s.probeErr }
+
+// newStubGroup creates a group over stubs named a, b, c... and waits for
+// its first round of probes, so the health of each member is settled.
+func newStubGroup(t *testing.T, strategy string, n int) (*Group, []*stubOutbound, *[]string) {
+	t.Helper()
+	dialed := &[]string{}
+	var names []string
+	var members []Outbound
+	var stubs []*stubOutbound
+	for i := 0; i < n; i++ {
+		s := &stubOutbound{name: string(rune('a' + i)), dialed: dialed}
+		names = append(names, s.name)
+		members = append(members, s)
+		stubs = append(stubs, s)
+	}
+	g, err := NewGroup("test", names, members, GroupOptions{Strategy: strategy, MaxFails: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Close()
+	return g, stubs, dialed
+}
+
+func TestGroupRoundRobin(t *testing.T) {
+	g, _, dialed := newStubGroup(t, RoundRobin, 3)
+	for i := 0; i < 6; i++ {
+		conn, err := g.DialTCP(context.Background(), "example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if got := strings.Join(*dialed, ""); got != "abcabc" {
+		t.Errorf("dialed %s, want abcabc", got)
+	}
+
+	// The counter wrapping around keeps the rotation valid.
+	g.next.Store(1<<32 - 1)
+	*dialed = nil
+	for i := 0; i < 2; i++ {
+		if _, err := g.DialTCP(context.Background(), "example.com:443"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(*dialed) != 2 {
+		t.Errorf("dialed %v after wraparound", *dialed)
+	}
+}
+
+func TestGroupLeastConn(t *testing.T) {
+	g, _, dialed := newStubGroup(t, LeastConn, 3)
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := g.DialTCP(context.Background(), "example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	// Closing twice releases the member once.
+	conns[1].Close()
+	conns[1].Close()
+	if _, err := g.DialUDP(context.Background(), "example.com:53"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(*dialed, ""); got != "abcb" {
+		t.Errorf("dialed %s, want abcb", got)
+	}
+	for i, want := range []int64{1, 1, 1} {
+		if got := g.members[i].conns.Load(); got != want {
+			t.Errorf("member %s has %d conns, want %d", g.members[i].name, got, want)
+		}
+	}
+}
+
+func TestGroupConsistentHash(t *testing.T) {
+	g, stubs, dialed := newStubGroup(t, ConsistentHash, 3)
+	pick := func(dst string) string {
+		*dialed = nil
+		if _, err := g.DialTCP(context.Background(), dst); err != nil {
+			t.Fatal(err)
+		}
+		return (*dialed)[len(*dialed)-1]
+	}
+
+	hosts := map[string]string{}
+	used := map[string]bool{}
+	for i := 0; i < 32; i++ {
+		host := fmt.Sprintf("host%d.example.com", i)
+		hosts[host] = pick(host + ":443")
+		used[hosts[host]] = true
+		if got := pick(host + ":80"); got != hosts[host] {
+			t.Errorf("%s: port 80 went to %s, port 443 to %s", host, got, hosts[host])
+		}
+	}
+	if len(used) != 3 {
+		t.Errorf("32 hosts spread over %d members, want 3", len(used))
+	}
+
+	// Only the hosts of an unhealthy member move.
+	g.members[0].healthy.Store(false)
+	for host, was := range hosts {
+		got := pick(host + ":443")
+		if was != stubs[0].name && got != was {
+			t.Errorf("%s moved from %s to %s", host, was, got)
+		}
+		if got == stubs[0].name {
+			t.Errorf("%s still sent to unhealthy member %s", host, got)
+		}
+	}
+}
+
+func TestGroupFailover(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	tests := []struct {
+		name      string
+		errs      []error // dial error of each member
+		dials     int
+		want      string // members dialed by each of the dials
+		wantErr   error
+		unhealthy []string
+	}{
+		{"first healthy", []error{nil, nil}, 2, "aa", nil, nil},
+		{"transport error", []error{refused, nil}, 3, "ab" + "ab" + "b", nil, []string{"a"}},
+		{"all down", []error{refused, refused}, 1, "ab", refused, nil},
+		{"destination error", []error{socks.ErrHostUnreachable, nil}, 3, "aaa", socks.ErrHostUnreachable, nil},
+		{"chain last hop", []error{&HopError{Hop: 2, Err: socks.ErrConnectionRefused, last: true}, nil}, 1, "a", socks.ErrConnectionRefused, nil},
+		{"chain inner hop", []error{&HopError{Hop: 1, Err: socks.ErrConnectionRefused}, nil}, 1, "ab", nil, nil},
+		{"http 502", []error{&HTTPError{StatusCode: 502}, nil}, 1, "a", &HTTPError{}, nil},
+		{"http 407", []error{&HTTPError{StatusCode: 407}, nil}, 1, "ab", nil, nil},
+		{"unsupported", []error{ErrUnsupported, nil}, 3, "ababab", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, stubs, dialed := newStubGroup(t, Failover, len(tt.errs))
+			for i, err := range tt.errs {
+				stubs[i].dialErr = err
+			}
+			var err error
+			for i := 0; i < tt.dials; i++ {
+				_, err = g.DialTCP(context.Background(), "example.com:443")
+			}
+			if got := strings.Join(*dialed, ""); got != tt.want {
+				t.Errorf("dialed %s, want %s", got, tt.want)
+			}
+			switch want := tt.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Errorf("got %v, want success", err)
+				}
+			case *HTTPError:
+				if !errors.As(err, &want) {
+					t.Errorf("got %v, want an HTTPError", err)
+				}
+			default:
+				if !errors.Is(err, want) {
+					t.Errorf("got %v, want %v", err, want)
+				}
+			}
+			for _, m := range g.members {
+				if want := !slices.Contains(tt.unhealthy, m.name); m.healthy.Load() != want {
+					t.Errorf("member %s healthy = %v, want %v", m.name, !want, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGroupHealth(t *testing.T) {
+	g, stubs, dialed := newStubGroup(t, Failover, 2)
+	down := errors.New("probe failed")
+
+	steps := []struct {
+		name     string
+		probeErr []error
+		want     string // member dialed next
+		healthy  []bool
+	}{
+		{"all healthy", []error{nil, nil}, "a", []bool{true, true}},
+		{"first down", []error{down, nil}, "b", []bool{false, true}},
+		// With every member unhealthy the group still tries them all.
+		{"all down", []error{down, down}, "a", []bool{false, false}},
+		{"first recovered", []error{nil, down}, "a", []bool{true, false}},
+	}
+	for _, s := range steps {
+		for i, err := range s.probeErr {
+			stubs[i].probeErr = err
+		}
+		g.probeAll()
+		*dialed = nil
+		if _, err := g.DialTCP(context.Background(), "example.com:443"); err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if (*dialed)[0] != s.want {
+			t.Errorf("%s: dialed %s, want %s", s.name, (*dialed)[0], s.want)
+		}
+		for i, m := range g.members {
+			if m.healthy.Load() != s.healthy[i] {
+				t.Errorf("%s: member %s healthy = %v, want %v", s.name, m.name, m.healthy.Load(), s.healthy[i])
+			}
+		}
+	}
+
+	// A successful probe also clears the failure count.
+	g.members[0].fails.Store(1)
+	stubs[0].probeErr = nil
+	g.probeAll()
+	if n := g.members[0].fails.Load(); n != 0 {
+		t.Errorf("fails = %d after a successful probe, want 0", n)
+	}
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+func init() {
+	Register("http", newHTTP)
+	Register("https", newHTTP)
+}
+
+// HTTP tunnels TCP through an HTTP proxy with the CONNECT method.
+// The https scheme speaks TLS to the proxy; the query parameters
+// ca (PEM file), sni and insecure tune the TLS client.
+type HTTP struct {
+	addr    string
+	auth    string
+	tls     *tls.Config
+	forward Dialer
+}
+
+// HTTPError is returned when the proxy answers CONNECT with a non-2xx status.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	if e.StatusCode == http.StatusProxyAuthRequired {
+		return "http proxy: authentication required: " + e.Status
+	}
+	return "http proxy: connect failed: " + e.Status
+}
+
+func newHTTP(u *url.URL, forward Dialer) (Outbound, error) {
+	h := &HTTP{forward: forward}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		h.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+	}
+	if u.Scheme != "https" {
+		h.addr = hostPort(u, "80")
+		return h, nil
+	}
+
+	h.addr = hostPort(u, "443")
+	query := u.Query()
+	h.tls = &tls.Config{ServerName: u.Hostname()}
+	if sni := query.Get("sni"); sni != "" {
+		h.tls.ServerName = sni
+	}
+	if insecure := query.Get("insecure"); insecure != "" {
+		skip, err := strconv.ParseBool(insecure)
+		if err != nil {
+			return nil, fmt.Errorf("http proxy: invalid insecure value %q", insecure)
+		}
+		h.tls.InsecureSkipVerify = skip
+	}
+	if ca := query.Get("ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("http proxy: no certificates found in %s", ca)
+		}
+		h.tls.RootCAs = pool
+	}
+	return h, nil
+}
+
+func (h *HTTP) DialTCP(ctx context.Context, dst string) (net.Conn, error) {
+	conn, err := h.forward.DialContext(ctx, "tcp", h.addr)
+	if err != nil {
+		return nil, err
+	}
+	if h.tls != nil {
+		tlsConn := tls.Client(conn, h.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	defer setDeadline(ctx, conn)()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: dst},
+		Host:   dst,
+		Header: make(http.Header),
+	}
+	if h.auth != "" {
+		req.Header.Set("Proxy-Authorization", h.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The body of a CONNECT response is the tunnel itself, so it is never read here.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		conn.Close()
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	// Bytes the server sent right after its response are already buffered.
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+func (h *HTTP) Servers() []string {
+	return []string{h.addr}
+}
+
+// Probe checks that the proxy accepts connections and, for https, completes
+// the TLS handshake.
+func (h *HTTP) Probe(ctx context.Context) error {
+	conn, err := h.forward.DialContext(ctx, "tcp", h.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if h.tls != nil {
+		return tls.Client(conn, h.tls).HandshakeContext(ctx)
+	}
+	return nil
+}
+
+func (h *HTTP) DialUDP(ctx context.Context, dst string) (net.PacketConn, error) {
+	return nil, fmt.Errorf("http proxy: udp to %s: %w", dst, ErrUnsupported)
+}
+
+// bufferedConn reads through r before falling back to the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
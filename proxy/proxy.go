@@ -0,0 +1,134 @@
+// Package proxy defines the outbound side of the engine: how a flow captured
+// on the TUN device reaches its destination. Outbounds are created from URLs
+// and looked up by scheme, so new transports can be plugged in with Register.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outbound opens connections to a destination given as "host:port".
+type Outbound interface {
+	// DialTCP returns a stream connected to dst.
+	DialTCP(ctx context.Context, dst string) (net.Conn, error)
+	// DialUDP returns a packet connection able to exchange datagrams with dst.
+	// Datagrams are addressed with WriteTo, replies report their source in ReadFrom.
+	DialUDP(ctx context.Context, dst string) (net.PacketConn, error)
+}
+
+// Server is implemented by outbounds that reach their destinations through
+// proxy servers. Servers returns the "host:port" of the servers they connect
+// to over the network.
+type Server interface {
+	Servers() []string
+}
+
+// Servers returns the proxy servers ob connects to, if it reports them.
+func Servers(ob Outbound) []string {
+	if s, ok := ob.(Server); ok {
+		return s.Servers()
+	}
+	return nil
+}
+
+// Dialer is the transport an Outbound uses to reach its own server.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Factory builds an Outbound from its URL. Connections to the proxy server
+// itself must be made through forward.
+type Factory func(u *url.URL, forward Dialer) (Outbound, error)
+
+// ErrUnsupported is returned by outbounds that cannot carry a kind of traffic.
+var ErrUnsupported = errors.New("proxy: unsupported operation")
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+)
+
+// Register makes an outbound available for URLs with the given scheme.
+// Registering the same scheme twice replaces the previous factory.
+func Register(scheme string, f Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[strings.ToLower(scheme)] = f
+}
+
+// New parses rawURL and creates the matching outbound. A bare "host:port"
+// is treated as a SOCKS5 proxy. Several comma-separated URLs form a chain,
+// outermost proxy first.
+func New(rawURL string) (Outbound, error) {
+	if urls := strings.Split(rawURL, ","); len(urls) > 1 {
+		return NewChain(SystemDialer(), urls...)
+	}
+	u, err := parseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return FromURL(u, SystemDialer())
+}
+
+// FromURL creates the outbound registered for u.Scheme on top of forward.
+func FromURL(u *url.URL, forward Dialer) (Outbound, error) {
+	factoriesMu.RLock()
+	f, ok := factories[strings.ToLower(u.Scheme)]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("proxy: unknown scheme %q", u.Scheme)
+	}
+	return f(u, forward)
+}
+
+// hostPort returns the server address of u, filling in defaultPort if missing.
+func hostPort(u *url.URL, defaultPort string) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// probeTCP connects to addr through forward and hangs up.
+func probeTCP(ctx context.Context, forward Dialer, addr string) error {
+	conn, err := forward.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// setDeadline applies the context deadline to conn for the duration of a
+// handshake. The returned func clears it again.
+func setDeadline(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		return func() { conn.SetDeadline(time.Time{}) }
+	}
+	return func() {}
+}
+
+// DialerOf adapts ob to a Dialer opening TCP streams through it, so that
+// clients such as DNS upstreams can be tunneled.
+func DialerOf(ob Outbound) Dialer {
+	return outboundDialer{ob}
+}
+
+type outboundDialer struct {
+	Outbound
+}
+
+func (d outboundDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("dial %s %s: %w", network, address, ErrUnsupported)
+	}
+	return d.DialTCP(ctx, address)
+}
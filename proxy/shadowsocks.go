@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/yimiaoxiehou/tun2socks/shadowsocks"
+	"github.com/yimiaoxiehou/tun2socks/socks"
+)
+
+func init() {
+	Register("ss", newShadowsocks)
+}
+
+// Shadowsocks tunnels TCP and UDP to a Shadowsocks AEAD server.
+// URLs follow SIP002: ss://base64url(method:password)@host:port,
+// or ss://method:password@host:port with percent-encoded userinfo.
+type Shadowsocks struct {
+	addr    string
+	cipher  *shadowsocks.Cipher
+	forward Dialer
+}
+
+func newShadowsocks(u *url.URL, forward Dialer) (Outbound, error) {
+	if plugin := u.Query().Get("plugin"); plugin != "" {
+		return nil, fmt.Errorf("shadowsocks: plugin %q is not supported", plugin)
+	}
+	if u.User == nil {
+		return nil, fmt.Errorf("shadowsocks: missing method and password in %s", u.Redacted())
+	}
+
+	method := u.User.Username()
+	password, ok := u.User.Password()
+	if !ok {
+		userinfo, err := decodeBase64(method)
+		if err != nil {
+			return nil, fmt.Errorf("shadowsocks: invalid userinfo: %v", err)
+		}
+		method, password, ok = strings.Cut(userinfo, ":")
+		if !ok {
+			return nil, fmt.Errorf("shadowsocks: userinfo is not method:password")
+		}
+	}
+
+	c, err := shadowsocks.NewCipher(method, password)
+	if err != nil {
+		return nil, err
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("shadowsocks: missing server port in %s", u.Redacted())
+	}
+	return &Shadowsocks{addr: u.Host, cipher: c, forward: forward}, nil
+}
+
+// decodeBase64 accepts the URL-safe alphabet SIP002 requires as well as
+// the standard one, with or without padding.
+func decodeBase64(s string) (string, error) {
+	s = strings.TrimRight(s, "=")
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		b, err = base64.RawStdEncoding.DecodeString(s)
+	}
+	return string(b), err
+}
+
+func (s *Shadowsocks) DialTCP(ctx context.Context, dst string) (net.Conn, error) {
+	addr, err := socks.ParseAddr(dst)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.forward.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	ssConn := shadowsocks.NewConn(conn, s.cipher)
+	// The target address travels in front of the first payload bytes.
+	if _, err := ssConn.Write(addr.AppendTo(nil)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssConn, nil
+}
+
+func (s *Shadowsocks) Servers() []string {
+	return []string{s.addr}
+}
+
+// Probe checks that the server accepts TCP connections.
+func (s *Shadowsocks) Probe(ctx context.Context) error {
+	return probeTCP(ctx, s.forward, s.addr)
+}
+
+func (s *Shadowsocks) DialUDP(ctx context.Context, dst string) (net.PacketConn, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := listenUDP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return shadowsocks.NewPacketConn(pc, serverAddr, s.cipher), nil
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/yimiaoxiehou/tun2socks/socks"
+)
+
+// SocketOptions are applied to every socket opened to reach the network,
+// so that proxied and direct traffic bypasses the TUN device instead of
+// looping back into it.
+type SocketOptions struct {
+	// Mark sets SO_MARK, for policy routing on Linux.
+	Mark int
+	// Interface binds sockets to a network interface: SO_BINDTODEVICE on
+	// Linux, IP_BOUND_IF on macOS. Sockets connecting to a loopback address,
+	// such as a local DNS server, are left unbound as they could not reach it.
+	Interface string
+	// Source is the local address sockets are bound to.
+	Source netip.Addr
+	// Protect is called with each socket before it connects, for embedders
+	// that exclude sockets from the VPN themselves, e.g. VpnService.protect.
+	Protect func(fd uintptr) error
+}
+
+var (
+	socketOptionsMu sync.RWMutex
+	socketOptions   SocketOptions
+)
+
+// socks.Control is set once here and reads the options under the lock, so
+// SetSocketOptions never writes it while connections are being dialed.
+func init() {
+	socks.Control = control
+}
+
+// SetSocketOptions changes the options of sockets opened from now on by
+// the outbounds, including those created before, and by socks.NewConn.
+// Call it before building outbounds, since groups start probing at once.
+func SetSocketOptions(o SocketOptions) {
+	socketOptionsMu.Lock()
+	socketOptions = o
+	socketOptionsMu.Unlock()
+}
+
+func currentSocketOptions() SocketOptions {
+	socketOptionsMu.RLock()
+	defer socketOptionsMu.RUnlock()
+	return socketOptions
+}
+
+// control applies the current socket options; socks.NewConn uses it.
+func control(network, address string, c syscall.RawConn) error {
+	return systemDialer{}.control(network, address, c)
+}
+
+// SystemDialer returns the Dialer outbounds use to reach their servers,
+// and direct connections their destinations. It follows SetSocketOptions.
+func SystemDialer() Dialer {
+	return systemDialer{}
+}
+
+// systemDialer opens sockets with the options of SetSocketOptions, where
+// the fields set in opts take precedence. Protect is always kept.
+type systemDialer struct {
+	opts *SocketOptions
+}
+
+func (d systemDialer) options() SocketOptions {
+	o := currentSocketOptions()
+	if d.opts == nil {
+		return o
+	}
+	if d.opts.Mark != 0 {
+		o.Mark = d.opts.Mark
+	}
+	if d.opts.Interface != "" {
+		o.Interface = d.opts.Interface
+	}
+	if d.opts.Source.IsValid() {
+		o.Source = d.opts.Source
+	}
+	return o
+}
+
+// control is the net.Dialer and net.ListenConfig hook applying the socket
+// options other than Source.
+func (d systemDialer) control(network, address string, c syscall.RawConn) error {
+	o := d.options()
+	if o.Interface != "" && loopback(address) {
+		o.Interface = ""
+	}
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if err = applySocketOptions(fd, network, &o); err == nil && o.Protect != nil {
+			err = o.Protect(fd)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// loopback reports whether address is a loopback IP and port.
+func loopback(address string) bool {
+	ap, err := netip.ParseAddrPort(address)
+	return err == nil && ap.Addr().Unmap().IsLoopback()
+}
+
+func (d systemDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	nd := &net.Dialer{Control: d.control}
+	if src := d.options().Source; src.IsValid() {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			nd.LocalAddr = &net.TCPAddr{IP: src.AsSlice()}
+		case "udp", "udp4", "udp6":
+			nd.LocalAddr = &net.UDPAddr{IP: src.AsSlice()}
+		}
+	}
+	return nd.DialContext(ctx, network, address)
+}
+
+// ListenUDP opens an unconnected UDP socket with the socket options.
+func (d systemDialer) ListenUDP(ctx context.Context) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: d.control}
+	laddr := ""
+	if src := d.options().Source; src.IsValid() {
+		laddr = netip.AddrPortFrom(src, 0).String()
+	}
+	return lc.ListenPacket(ctx, "udp", laddr)
+}
+
+// listenUDP opens an unconnected UDP socket following SetSocketOptions.
+func listenUDP(ctx context.Context) (net.PacketConn, error) {
+	return systemDialer{}.ListenUDP(ctx)
+}
+
+// parseSocketOptions reads the mark, interface and source query parameters
+// of an outbound URL. ok is false when none is given.
+func parseSocketOptions(q url.Values) (o SocketOptions, ok bool, err error) {
+	if v := q.Get("mark"); v != "" {
+		mark, err := strconv.ParseUint(v, 0, 32)
+		if err != nil {
+			return o, false, fmt.Errorf("invalid mark %q", v)
+		}
+		o.Mark, ok = int(mark), true
+	}
+	if v := q.Get("interface"); v != "" {
+		o.Interface, ok = v, true
+	}
+	if v := q.Get("source"); v != "" {
+		if o.Source, err = netip.ParseAddr(v); err != nil {
+			return o, false, fmt.Errorf("invalid source %q", v)
+		}
+		ok = true
+	}
+	return o, ok, nil
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+func applySocketOptions(fd uintptr, network string, o *SocketOptions) error {
+	if o.Mark != 0 {
+		return errors.New("proxy: socket mark is only supported on Linux")
+	}
+	if o.Interface != "" {
+		ifi, err := net.InterfaceByName(o.Interface)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(network, "6") {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_BOUND_IF, ifi.Index)
+		} else {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BOUND_IF, ifi.Index)
+		}
+		if err != nil {
+			return os.NewSyscallError("setsockopt IP_BOUND_IF", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"os"
+	"syscall"
+)
+
+func applySocketOptions(fd uintptr, network string, o *SocketOptions) error {
+	if o.Mark != 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, o.Mark); err != nil {
+			return os.NewSyscallError("setsockopt SO_MARK", err)
+		}
+	}
+	if o.Interface != "" {
+		if err := syscall.BindToDevice(int(fd), o.Interface); err != nil {
+			return os.NewSyscallError("setsockopt SO_BINDTODEVICE", err)
+		}
+	}
+	return nil
+}
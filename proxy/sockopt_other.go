@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package proxy
+
+import "errors"
+
+func applySocketOptions(fd uintptr, network string, o *SocketOptions) error {
+	if o.Mark != 0 || o.Interface != "" {
+		return errors.New("proxy: socket mark and interface binding are not supported on this platform")
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/yimiaoxiehou/tun2socks/socks"
+)
+
+func init() {
+	Register("socks4", newSocks4)
+	Register("socks4a", newSocks4)
+}
+
+// Socks4 tunnels TCP with a SOCKS4 CONNECT. With socks4a, domain
+// destinations are resolved by the server; plain socks4 resolves them locally.
+// The URL username is sent as USERID.
+type Socks4 struct {
+	addr    string
+	userID  string
+	socks4a bool
+	forward Dialer
+}
+
+func newSocks4(u *url.URL, forward Dialer) (Outbound, error) {
+	return &Socks4{
+		addr:    hostPort(u, "1080"),
+		userID:  u.User.Username(),
+		socks4a: u.Scheme == "socks4a",
+		forward: forward,
+	}, nil
+}
+
+func (s *Socks4) DialTCP(ctx context.Context, dst string) (net.Conn, error) {
+	addr, err := socks.ParseAddr(dst)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP == nil && !s.socks4a {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", addr.Name)
+		if err != nil {
+			return nil, err
+		}
+		addr = &socks.Addr{IP: ips[0], Port: addr.Port}
+	}
+	if addr.IP != nil && addr.IP.To4() == nil {
+		return nil, socks.ErrSocks4IPv6
+	}
+
+	conn, err := s.forward.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer setDeadline(ctx, conn)()
+	if err := socks.Socks4Connect(conn, addr, s.userID, s.socks4a); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *Socks4) Servers() []string {
+	return []string{s.addr}
+}
+
+// Probe checks that the server accepts TCP connections.
+func (s *Socks4) Probe(ctx context.Context) error {
+	return probeTCP(ctx, s.forward, s.addr)
+}
+
+func (s *Socks4) DialUDP(ctx context.Context, dst string) (net.PacketConn, error) {
+	return nil, fmt.Errorf("socks4: udp to %s: %w", dst, ErrUnsupported)
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/url"
+
+	"github.com/yimiaoxiehou/tun2socks/socks"
+)
+
+func init() {
+	Register("socks5", newSocks5)
+	Register("socks5h", newSocks5)
+}
+
+// Socks5 tunnels TCP with CONNECT and UDP with UDP ASSOCIATE.
+type Socks5 struct {
+	addr    string
+	user    *url.Userinfo
+	forward Dialer
+}
+
+func newSocks5(u *url.URL, forward Dialer) (Outbound, error) {
+	return &Socks5{addr: hostPort(u, "1080"), user: u.User, forward: forward}, nil
+}
+
+// dial connects to the proxy server and completes the method negotiation.
+func (s *Socks5) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := s.forward.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer setDeadline(ctx, conn)()
+	if err := socks.Handshake(conn, s.user); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *Socks5) Servers() []string {
+	return []string{s.addr}
+}
+
+// Probe checks that the server completes the method negotiation.
+func (s *Socks5) Probe(ctx context.Context) error {
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (s *Socks5) DialTCP(ctx context.Context, dst string) (net.Conn, error) {
+	addr, err := socks.ParseAddr(dst)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer setDeadline(ctx, conn)()
+	if _, err := socks.Request(conn, uint8(socks.SOCKS5_CONNECT_CMD), addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *Socks5) DialUDP(ctx context.Context, dst string) (net.PacketConn, error) {
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer setDeadline(ctx, conn)()
+	host, _, _ := net.SplitHostPort(s.addr)
+	return socks.Associate(ctx, conn, host)
+}
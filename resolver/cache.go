@@ -0,0 +1,231 @@
+package resolver
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// prefetchHits is how often an entry must be served before it counts
+	// as popular and is refreshed ahead of expiry.
+	prefetchHits = 2
+	// prefetchWindow is the fraction of its TTL an entry has left when a
+	// popular entry is refreshed.
+	prefetchWindow = 10
+)
+
+// CacheStats counts cache activity since creation or the last flush.
+type CacheStats struct {
+	Size       int
+	Hits       uint64
+	Misses     uint64
+	Prefetches uint64
+	Evictions  uint64
+}
+
+// Cache keeps upstream responses keyed by question for as long as their
+// records live. Negative answers are kept for the SOA minimum of RFC 2308,
+// responses without a SOA are not cached. TTLs are clamped to
+// [MinTTL, MaxTTL] and the least recently used entry is evicted beyond Size.
+type Cache struct {
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	Size   int
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used at the front
+	entries map[question]*list.Element
+	stats   CacheStats
+}
+
+type question struct {
+	name  string
+	typ   dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type cacheEntry struct {
+	key         question
+	msg         dnsmessage.Message
+	stored      time.Time
+	ttl         time.Duration
+	hits        int
+	prefetching bool
+}
+
+// NewCache creates a cache holding up to size responses.
+func NewCache(size int, minTTL, maxTTL time.Duration) *Cache {
+	return &Cache{
+		MinTTL:  minTTL,
+		MaxTTL:  maxTTL,
+		Size:    size,
+		lru:     list.New(),
+		entries: map[question]*list.Element{},
+	}
+}
+
+// questionOf returns the cache key of a query and its question as sent.
+func questionOf(query []byte) (question, dnsmessage.Question, bool) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return question{}, dnsmessage.Question{}, false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return question{}, dnsmessage.Question{}, false
+	}
+	return question{canonical(q.Name.String()), q.Type, q.Class}, q, true
+}
+
+// get returns a cached response for q with the given ID and TTLs counted
+// down. prefetch reports that the caller should refresh the entry.
+func (c *Cache) get(key question, q dnsmessage.Question, id uint16) (resp []byte, prefetch bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	elapsed := time.Since(e.stored)
+	if elapsed >= e.ttl {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		c.stats.Misses++
+		return nil, false
+	}
+
+	msg := e.msg
+	msg.ID = id
+	msg.Questions = []dnsmessage.Question{q}
+	msg.Answers = c.countDown(e.msg.Answers, elapsed)
+	msg.Authorities = c.countDown(e.msg.Authorities, elapsed)
+	msg.Additionals = c.countDown(e.msg.Additionals, elapsed)
+	resp, err := msg.Pack()
+	if err != nil {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	c.stats.Hits++
+	e.hits++
+	if e.hits >= prefetchHits && !e.prefetching && e.ttl-elapsed <= e.ttl/prefetchWindow {
+		e.prefetching = true
+		c.stats.Prefetches++
+		prefetch = true
+	}
+	return resp, prefetch
+}
+
+// endPrefetch lets key be prefetched again. A successful refresh replaces
+// the entry, so this only matters when the refresh failed or was not
+// cacheable, and the next hit should retry it.
+func (c *Cache) endPrefetch(key question) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*cacheEntry).prefetching = false
+	}
+}
+
+// countDown copies rs with each TTL clamped and reduced by elapsed.
+func (c *Cache) countDown(rs []dnsmessage.Resource, elapsed time.Duration) []dnsmessage.Resource {
+	out := make([]dnsmessage.Resource, len(rs))
+	for i, r := range rs {
+		out[i] = r
+		if r.Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		ttl := c.clamp(time.Duration(r.Header.TTL)*time.Second) - elapsed
+		if ttl < 0 {
+			ttl = 0
+		}
+		out[i].Header.TTL = uint32(ttl / time.Second)
+	}
+	return out
+}
+
+func (c *Cache) clamp(ttl time.Duration) time.Duration {
+	if ttl < c.MinTTL {
+		ttl = c.MinTTL
+	}
+	if c.MaxTTL > 0 && ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	return ttl
+}
+
+// put stores a response unless it is truncated, a failure, or carries no
+// usable TTL.
+func (c *Cache) put(key question, resp []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil || msg.Truncated {
+		return
+	}
+	ttl, ok := cacheTTL(&msg)
+	if !ok {
+		return
+	}
+	ttl = c.clamp(ttl)
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+	}
+	e := &cacheEntry{key: key, msg: msg, stored: time.Now(), ttl: ttl}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+// cacheTTL returns how long msg may be cached: the lowest answer TTL, or
+// for NXDOMAIN and NODATA the lower of the SOA TTL and its minimum field.
+func cacheTTL(msg *dnsmessage.Message) (time.Duration, bool) {
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return 0, false
+	}
+	if msg.RCode == dnsmessage.RCodeSuccess && len(msg.Answers) > 0 {
+		ttl := msg.Answers[0].Header.TTL
+		for _, r := range msg.Answers[1:] {
+			ttl = min(ttl, r.Header.TTL)
+		}
+		return time.Duration(ttl) * time.Second, true
+	}
+	for _, r := range msg.Authorities {
+		if soa, ok := r.Body.(*dnsmessage.SOAResource); ok {
+			return time.Duration(min(r.Header.TTL, soa.MinTTL)) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// Flush drops every entry and resets the counters.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = map[question]*list.Element{}
+	c.stats = CacheStats{}
+}
+
+// Stats returns a snapshot of the counters.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Size = c.lru.Len()
+	return s
+}
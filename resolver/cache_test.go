@@ -0,0 +1,327 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var testSOA = dnsmessage.Resource{
+	Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+	Body: &dnsmessage.SOAResource{
+		NS:     dnsmessage.MustNewName("ns.example.com."),
+		MBox:   dnsmessage.MustNewName("hostmaster.example.com."),
+		MinTTL: 300,
+	},
+}
+
+func aRecord(ttl uint32, ip byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("www.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, ip}},
+	}
+}
+
+// testQuery returns the cache key and question of an A query for name.
+func testQuery(t *testing.T, name string) (question, dnsmessage.Question) {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, q, ok := questionOf(b)
+	if !ok {
+		t.Fatalf("questionOf(%s) failed", name)
+	}
+	return key, q
+}
+
+func testResponse(t *testing.T, rcode dnsmessage.RCode, answers, authorities []dnsmessage.Resource) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, RCode: rcode},
+		Questions:   []dnsmessage.Question{{Name: dnsmessage.MustNewName("www.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		Answers:     answers,
+		Authorities: authorities,
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// answerTTLs unpacks a cached response and returns its ID and answer TTLs.
+func answerTTLs(t *testing.T, resp []byte) (uint16, []uint32) {
+	t.Helper()
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	var ttls []uint32
+	for _, r := range append(msg.Answers, msg.Authorities...) {
+		ttls = append(ttls, r.Header.TTL)
+	}
+	return msg.ID, ttls
+}
+
+// ttlNear reports whether got is want, allowing for the time the test
+// itself took to be rounded down to a second.
+func ttlNear(got, want uint32) bool {
+	return got == want || got+1 == want
+}
+
+func TestCacheTTL(t *testing.T) {
+	soaLow := testSOA
+	soaLow.Header.TTL = 60
+	tests := []struct {
+		name        string
+		rcode       dnsmessage.RCode
+		answers     []dnsmessage.Resource
+		authorities []dnsmessage.Resource
+		want        time.Duration
+		ok          bool
+	}{
+		{"lowest answer", dnsmessage.RCodeSuccess, []dnsmessage.Resource{aRecord(300, 1), aRecord(120, 2)}, nil, 120 * time.Second, true},
+		{"nxdomain soa minimum", dnsmessage.RCodeNameError, nil, []dnsmessage.Resource{testSOA}, 300 * time.Second, true},
+		{"nodata soa ttl", dnsmessage.RCodeSuccess, nil, []dnsmessage.Resource{soaLow}, 60 * time.Second, true},
+		{"nxdomain without soa", dnsmessage.RCodeNameError, nil, nil, 0, false},
+		{"nodata without soa", dnsmessage.RCodeSuccess, nil, nil, 0, false},
+		{"servfail", dnsmessage.RCodeServerFailure, nil, []dnsmessage.Resource{testSOA}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := dnsmessage.Message{Header: dnsmessage.Header{RCode: tt.rcode}, Answers: tt.answers, Authorities: tt.authorities}
+			got, ok := cacheTTL(&msg)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("cacheTTL = %v, %v; want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCacheClamp(t *testing.T) {
+	tests := []struct {
+		name   string
+		min    time.Duration
+		max    time.Duration
+		ttl    uint32
+		want   uint32
+		cached bool
+	}{
+		{"within bounds", 10 * time.Second, time.Hour, 300, 300, true},
+		{"raised to min", time.Minute, time.Hour, 5, 60, true},
+		{"lowered to max", 0, time.Minute, 3600, 60, true},
+		{"no max", 0, 0, 86400, 86400, true},
+		{"zero ttl", 0, time.Hour, 0, 0, false},
+		{"zero ttl with min", 30 * time.Second, time.Hour, 0, 30, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(8, tt.min, tt.max)
+			key, q := testQuery(t, "www.example.com.")
+			c.put(key, testResponse(t, dnsmessage.RCodeSuccess, []dnsmessage.Resource{aRecord(tt.ttl, 1)}, nil))
+			resp, _ := c.get(key, q, 1)
+			if (resp != nil) != tt.cached {
+				t.Fatalf("cached = %v, want %v", resp != nil, tt.cached)
+			}
+			if !tt.cached {
+				return
+			}
+			if _, ttls := answerTTLs(t, resp); !ttlNear(ttls[0], tt.want) {
+				t.Errorf("TTL = %d, want %d", ttls[0], tt.want)
+			}
+		})
+	}
+}
+
+// age moves the store time of the entry for key back by d.
+func (c *Cache) age(key question, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key].Value.(*cacheEntry).stored = time.Now().Add(-d)
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := NewCache(8, 0, time.Hour)
+	key, q := testQuery(t, "www.example.com.")
+	c.put(key, testResponse(t, dnsmessage.RCodeSuccess, []dnsmessage.Resource{aRecord(60, 1), aRecord(90, 2)}, nil))
+
+	// Every record counts down from its own TTL, the entry lives as long
+	// as the lowest.
+	c.age(key, 40*time.Second)
+	resp, _ := c.get(key, q, 0x1234)
+	if resp == nil {
+		t.Fatal("entry missing before expiry")
+	}
+	id, ttls := answerTTLs(t, resp)
+	if id != 0x1234 {
+		t.Errorf("ID = %#x, want 0x1234", id)
+	}
+	if len(ttls) != 2 || !ttlNear(ttls[0], 20) || !ttlNear(ttls[1], 50) {
+		t.Errorf("TTLs = %v, want [20 50]", ttls)
+	}
+
+	c.age(key, 60*time.Second)
+	if resp, _ := c.get(key, q, 1); resp != nil {
+		t.Error("entry served after expiry")
+	}
+	if s := c.Stats(); s.Size != 0 || s.Hits != 1 || s.Misses != 1 {
+		t.Errorf("Stats = %+v, want size 0, 1 hit, 1 miss", s)
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	tests := []struct {
+		name        string
+		rcode       dnsmessage.RCode
+		authorities []dnsmessage.Resource
+		cached      bool
+	}{
+		{"nxdomain", dnsmessage.RCodeNameError, []dnsmessage.Resource{testSOA}, true},
+		{"nodata", dnsmessage.RCodeSuccess, []dnsmessage.Resource{testSOA}, true},
+		{"nxdomain without soa", dnsmessage.RCodeNameError, nil, false},
+		{"servfail", dnsmessage.RCodeServerFailure, []dnsmessage.Resource{testSOA}, false},
+		{"refused", dnsmessage.RCodeRefused, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(8, 0, time.Hour)
+			key, q := testQuery(t, "www.example.com.")
+			c.put(key, testResponse(t, tt.rcode, nil, tt.authorities))
+			resp, _ := c.get(key, q, 1)
+			if (resp != nil) != tt.cached {
+				t.Fatalf("cached = %v, want %v", resp != nil, tt.cached)
+			}
+			if !tt.cached {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			if msg.RCode != tt.rcode || len(msg.Authorities) != 1 {
+				t.Errorf("RCode = %v with %d authorities, want %v with the SOA", msg.RCode, len(msg.Authorities), tt.rcode)
+			}
+
+			// The negative entry lives for the SOA minimum, not its TTL.
+			c.age(key, 300*time.Second)
+			if resp, _ := c.get(key, q, 1); resp != nil {
+				t.Error("negative entry served past the SOA minimum")
+			}
+		})
+	}
+}
+
+func TestCacheQuestion(t *testing.T) {
+	c := NewCache(8, 0, time.Hour)
+	key, _ := testQuery(t, "www.example.com.")
+	c.put(key, testResponse(t, dnsmessage.RCodeSuccess, []dnsmessage.Resource{aRecord(300, 1)}, nil))
+
+	// Names differing in case share the entry and get their own question back.
+	mixedKey, mixed := testQuery(t, "WwW.Example.COM.")
+	if mixedKey != key {
+		t.Fatalf("key %v differs from %v", mixedKey, key)
+	}
+	resp, _ := c.get(mixedKey, mixed, 2)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Questions[0].Name.String(); got != "WwW.Example.COM." {
+		t.Errorf("question = %s, want WwW.Example.COM.", got)
+	}
+
+	// Truncated responses are not cached.
+	otherKey, other := testQuery(t, "other.example.com.")
+	var tc dnsmessage.Message
+	tc.Unpack(testResponse(t, dnsmessage.RCodeSuccess, []dnsmessage.Resource{aRecord(300, 1)}, nil))
+	tc.Truncated = true
+	truncated, _ := tc.Pack()
+	c.put(otherKey, truncated)
+	if resp, _ := c.get(otherKey, other, 3); resp != nil {
+		t.Error("truncated response cached")
+	}
+}
+
+func TestCacheEvictFlush(t *testing.T) {
+	c := NewCache(2, 0, time.Hour)
+	resp := testResponse(t, dnsmessage.RCodeSuccess, []dnsmessage.Resource{aRecord(300, 1)}, nil)
+	a, qa := testQuery(t, "a.example.com.")
+	b, qb := testQuery(t, "b.example.com.")
+	d, qd := testQuery(t, "d.example.com.")
+	c.put(a, resp)
+	c.put(b, resp)
+	c.get(a, qa, 1) // b becomes the least recently used
+	c.put(d, resp)
+
+	if r, _ := c.get(b, qb, 1); r != nil {
+		t.Error("least recently used entry not evicted")
+	}
+	if r, _ := c.get(a, qa, 1); r == nil {
+		t.Error("recently used entry evicted")
+	}
+	if r, _ := c.get(d, qd, 1); r == nil {
+		t.Error("new entry missing")
+	}
+	want := CacheStats{Size: 2, Hits: 3, Misses: 1, Evictions: 1}
+	if s := c.Stats(); s != want {
+		t.Errorf("Stats = %+v, want %+v", s, want)
+	}
+
+	c.Flush()
+	if s := c.Stats(); s != (CacheStats{}) {
+		t.Errorf("Stats after Flush = %+v, want zero", s)
+	}
+	if r, _ := c.get(a, qa, 1); r != nil {
+		t.Error("entry served after Flush")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	c := NewCache(8, 0, time.Hour)
+	key, q := testQuery(t, "www.example.com.")
+	c.put(key, testResponse(t, dnsmessage.RCodeSuccess, []dnsmessage.Resource{aRecord(100, 1)}, nil))
+
+	// Popular entries are refreshed once within the last tenth of their TTL.
+	steps := []struct {
+		age      time.Duration
+		prefetch bool
+	}{
+		{50 * time.Second, false},
+		{95 * time.Second, true},
+		{96 * time.Second, false},
+	}
+	for _, s := range steps {
+		c.age(key, s.age)
+		if _, prefetch := c.get(key, q, 1); prefetch != s.prefetch {
+			t.Errorf("at %v: prefetch = %v, want %v", s.age, prefetch, s.prefetch)
+		}
+	}
+	if s := c.Stats(); s.Prefetches != 1 {
+		t.Errorf("Prefetches = %d, want 1", s.Prefetches)
+	}
+
+	// A failed refresh leaves the entry to be prefetched on the next hit.
+	r := &Resolver{Cache: c}
+	r.prefetch([]Upstream{failingUpstream{}}, key, nil)
+	c.age(key, 97*time.Second)
+	if _, prefetch := c.get(key, q, 1); !prefetch {
+		t.Error("no prefetch after a failed one")
+	}
+}
+
+type failingUpstream struct{}
+
+func (failingUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return nil, errors.New("upstream down")
+}
+
+func (failingUpstream) String() string { return "failing" }
@@ -0,0 +1,213 @@
+package resolver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// localTTL is the TTL of answers made up from Hosts and Block.
+const localTTL = 60
+
+// Hosts is a static name to address table in hosts file format:
+//
+//	10.0.0.5   git.corp.example git
+//	fd00::5    git.corp.example
+//
+// Names match exactly, and a listed name has no addresses of other families.
+type Hosts struct {
+	addrs map[string][]netip.Addr
+}
+
+// LoadHosts reads a hosts file.
+func LoadHosts(path string) (*Hosts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseHosts(f)
+}
+
+// ParseHosts reads entries in hosts file format.
+func ParseHosts(r io.Reader) (*Hosts, error) {
+	h := &Hosts{addrs: map[string][]netip.Addr{}}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || len(fields) < 2 {
+			return nil, fmt.Errorf("hosts line %d: want address followed by names", line)
+		}
+		for _, name := range fields[1:] {
+			name = canonical(name)
+			h.addrs[name] = append(h.addrs[name], addr.Unmap())
+		}
+	}
+	return h, scanner.Err()
+}
+
+// Lookup returns the addresses listed for name.
+func (h *Hosts) Lookup(name string) ([]netip.Addr, bool) {
+	addrs, ok := h.addrs[canonical(name)]
+	return addrs, ok
+}
+
+// Blocklist answers queries for listed domains and their subdomains with
+// NXDOMAIN, or with 0.0.0.0 and :: when Zero is set. The file lists one
+// domain per line; hosts file lines such as "0.0.0.0 ads.example
+// tracker.example" are accepted too, skipping the loopback and broadcast
+// names such files conventionally start with.
+type Blocklist struct {
+	Zero    bool
+	domains map[string]struct{}
+}
+
+// LoadBlocklist reads a blocklist file.
+func LoadBlocklist(path string, zero bool) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseBlocklist(f, zero)
+}
+
+// ParseBlocklist reads domains in the blocklist file format.
+func ParseBlocklist(r io.Reader, zero bool) (*Blocklist, error) {
+	b := &Blocklist{Zero: zero, domains: map[string]struct{}{}}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		// A hosts file line lists every name after the address.
+		names, hostsLine := fields[:1], false
+		if _, err := netip.ParseAddr(fields[0]); err == nil {
+			names, hostsLine = fields[1:], true
+		}
+		for _, name := range names {
+			name = canonical(name)
+			if _, ok := hostsNames[name]; ok && hostsLine {
+				continue
+			}
+			b.domains[name] = struct{}{}
+		}
+	}
+	return b, scanner.Err()
+}
+
+// hostsNames are the names hosts-format blocklists carry over from a
+// system hosts file, such as "127.0.0.1 localhost". Blocking them would
+// break loopback lookups, and "local" every mDNS name.
+var hostsNames = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+	"0.0.0.0":               {},
+}
+
+// Blocked reports whether name or one of its parent domains is listed.
+func (b *Blocklist) Blocked(name string) bool {
+	name = canonical(name)
+	for {
+		if _, ok := b.domains[name]; ok {
+			return true
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			return false
+		}
+		name = parent
+	}
+}
+
+// AnswerLocal answers a query from Block or Hosts without contacting an
+// upstream. ok is false when neither has an answer.
+func (r *Resolver) AnswerLocal(query []byte) (resp []byte, ok bool) {
+	key, q, ok := questionOf(query)
+	if !ok {
+		return nil, false
+	}
+	return r.answerLocal(query, key.name, q)
+}
+
+// answerLocal answers a query from Block or Hosts. name is canonical.
+func (r *Resolver) answerLocal(query []byte, name string, q dnsmessage.Question) ([]byte, bool) {
+	if q.Class != dnsmessage.ClassINET {
+		return nil, false
+	}
+	if r.Block != nil && r.Block.Blocked(name) {
+		if !r.Block.Zero {
+			return localResponse(query, q, dnsmessage.RCodeNameError, nil)
+		}
+		return localResponse(query, q, dnsmessage.RCodeSuccess,
+			[]netip.Addr{netip.IPv4Unspecified(), netip.IPv6Unspecified()})
+	}
+	if r.Hosts != nil && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA) {
+		if addrs, ok := r.Hosts.Lookup(name); ok {
+			return localResponse(query, q, dnsmessage.RCodeSuccess, addrs)
+		}
+	}
+	return nil, false
+}
+
+// localResponse builds a response to query answering q with the addresses
+// of the family it asks for.
+func localResponse(query []byte, q dnsmessage.Question, rcode dnsmessage.RCode, addrs []netip.Addr) ([]byte, bool) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, false
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, false
+	}
+	if err := b.Question(q); err != nil {
+		return nil, false
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, false
+	}
+	h := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: localTTL}
+	for _, addr := range addrs {
+		switch {
+		case q.Type == dnsmessage.TypeA && addr.Is4():
+			err = b.AResource(h, dnsmessage.AResource{A: addr.As4()})
+		case q.Type == dnsmessage.TypeAAAA && addr.Is6():
+			err = b.AAAAResource(h, dnsmessage.AAAAResource{AAAA: addr.As16()})
+		}
+		if err != nil {
+			return nil, false
+		}
+	}
+	resp, err := b.Finish()
+	return resp, err == nil
+}
@@ -0,0 +1,236 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseHosts(t *testing.T) {
+	h, err := ParseHosts(strings.NewReader(`
+# static names
+10.0.0.5      git.corp.example git   # trailing comment
+fd00::5       GIT.corp.example.
+::ffff:10.0.0.6 wiki.corp.example
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"git.corp.example", []string{"10.0.0.5", "fd00::5"}},
+		{"Git.Corp.Example.", []string{"10.0.0.5", "fd00::5"}},
+		{"git", []string{"10.0.0.5"}},
+		{"wiki.corp.example", []string{"10.0.0.6"}},
+		{"corp.example", nil},
+		{"x.git.corp.example", nil},
+	}
+	for _, tt := range tests {
+		addrs, ok := h.Lookup(tt.name)
+		var got []string
+		for _, addr := range addrs {
+			got = append(got, addr.String())
+		}
+		if ok != (tt.want != nil) || !slices.Equal(got, tt.want) {
+			t.Errorf("Lookup(%s) = %v, %v; want %v", tt.name, got, ok, tt.want)
+		}
+	}
+
+	for _, text := range []string{"10.0.0.5\n", "git.corp.example 10.0.0.5\n", "# ok\n10.0.0.256 x\n"} {
+		if _, err := ParseHosts(strings.NewReader(text)); err == nil {
+			t.Errorf("ParseHosts(%q) accepted", text)
+		}
+	}
+}
+
+func TestParseBlocklist(t *testing.T) {
+	b, err := ParseBlocklist(strings.NewReader(`
+# domain list
+Ads.Example.
+tracker.example   # comment
+# hosts format
+127.0.0.1  localhost localhost.localdomain local
+255.255.255.255 broadcasthost
+::1        localhost ip6-localhost ip6-loopback
+fe00::0    ip6-localnet
+0.0.0.0    0.0.0.0
+0.0.0.0    popup.example metrics.example
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		blocked bool
+	}{
+		{"ads.example", true},
+		{"ADS.example.", true},
+		{"cdn.ads.example", true},
+		{"tracker.example", true},
+		{"popup.example", true},
+		{"x.metrics.example", true},
+		{"example", false},
+		{"myads.example", false},
+		{"localhost", false},
+		{"app.localhost", false},
+		{"localhost.localdomain", false},
+		{"printer.local", false},
+		{"broadcasthost", false},
+		{"ip6-localhost", false},
+		{"ip6-loopback", false},
+		{"ip6-localnet", false},
+	}
+	for _, tt := range tests {
+		if got := b.Blocked(tt.name); got != tt.blocked {
+			t.Errorf("Blocked(%s) = %v, want %v", tt.name, got, tt.blocked)
+		}
+	}
+
+	// Listed as a plain domain, localhost is blocked like any other.
+	b, err = ParseBlocklist(strings.NewReader("localhost\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Blocked("localhost") {
+		t.Error("a plain localhost line is not blocked")
+	}
+}
+
+func TestZones(t *testing.T) {
+	r, err := New("udp://192.0.2.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, z := range []struct{ suffix, upstreams string }{
+		{"example", "udp://192.0.2.2"},
+		{"Corp.Example.", "tcp://192.0.2.3,udp://192.0.2.4"},
+	} {
+		if err := r.AddZone(z.suffix, z.upstreams, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.AddZone("lan", "udp://192.0.2.5?via=corp", nil); err == nil {
+		t.Error("AddZone accepted udp through an outbound")
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"git.corp.example", "tcp://192.0.2.3:53,udp://192.0.2.4:53"},
+		{"corp.example", "tcp://192.0.2.3:53,udp://192.0.2.4:53"},
+		{"xcorp.example", "udp://192.0.2.2:53"},
+		{"example", "udp://192.0.2.2:53"},
+		{"example.com", "udp://192.0.2.1:53"},
+		{"notexample", "udp://192.0.2.1:53"},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, u := range r.upstreamsFor(tt.name) {
+			got = append(got, u.String())
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("upstreamsFor(%s) = %v, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAnswerLocal(t *testing.T) {
+	hosts, err := ParseHosts(strings.NewReader("10.0.0.5 git.corp.example\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ParseBlocklist(strings.NewReader("ads.example\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Resolver{Hosts: hosts, Block: block}
+
+	answer := func(name string, typ dnsmessage.Type) *dnsmessage.Message {
+		t.Helper()
+		query := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: 9, RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}},
+		}
+		b, err := query.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, ok := r.AnswerLocal(b)
+		if !ok {
+			return nil
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(resp); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID != 9 || !msg.Response {
+			t.Errorf("%s: header %+v", name, msg.Header)
+		}
+		return &msg
+	}
+
+	if msg := answer("git.corp.example.", dnsmessage.TypeA); msg == nil || len(msg.Answers) != 1 ||
+		msg.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{10, 0, 0, 5} {
+		t.Errorf("A git.corp.example = %+v", msg)
+	}
+	// A listed name has no addresses of the other family.
+	if msg := answer("git.corp.example.", dnsmessage.TypeAAAA); msg == nil || msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 0 {
+		t.Errorf("AAAA git.corp.example = %+v, want an empty answer", msg)
+	}
+	if msg := answer("x.ads.example.", dnsmessage.TypeMX); msg == nil || msg.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("MX x.ads.example = %+v, want NXDOMAIN", msg)
+	}
+	if msg := answer("example.com.", dnsmessage.TypeA); msg != nil {
+		t.Errorf("A example.com answered locally: %+v", msg)
+	}
+
+	block.Zero = true
+	msg := answer("ads.example.", dnsmessage.TypeAAAA)
+	if msg == nil || len(msg.Answers) != 1 || msg.Answers[0].Body.(*dnsmessage.AAAAResource).AAAA != netip.IPv6Unspecified().As16() {
+		t.Errorf("AAAA ads.example = %+v, want ::", msg)
+	}
+}
+
+// countingUpstream echoes queries back as responses and counts them.
+type countingUpstream struct{ n int }
+
+func (u *countingUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	u.n++
+	resp := append([]byte(nil), query...)
+	resp[2] |= 0x80
+	return resp, nil
+}
+
+func (u *countingUpstream) String() string { return "counting" }
+
+func TestExchangeLocal(t *testing.T) {
+	hosts, err := ParseHosts(strings.NewReader("10.0.0.5 git.corp.example\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := &countingUpstream{}
+	r := &Resolver{Upstreams: []Upstream{up}, Hosts: hosts}
+	query, err := (&dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("git.corp.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, _ := r.AnswerLocal(query)
+	if resp, err := r.Exchange(context.Background(), query); err != nil || !bytes.Equal(resp, local) || up.n != 0 {
+		t.Errorf("Exchange = %x, %v after %d upstream queries; want the local answer %x", resp, err, up.n, local)
+	}
+	// Forward leaves Block and Hosts to the caller.
+	if _, err := r.Forward(context.Background(), query); err != nil || up.n != 1 {
+		t.Errorf("Forward: %v after %d upstream queries, want 1", err, up.n)
+	}
+}
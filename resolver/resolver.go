@@ -0,0 +1,182 @@
+// Package resolver answers DNS queries intercepted on the TUN device by
+// forwarding them to configurable upstream servers.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/yimiaoxiehou/tun2socks/proxy"
+)
+
+// Resolver tries its upstreams in order until one answers. Names under a
+// zone suffix go to the zone's upstreams instead. Block and Hosts, when
+// set, answer matching names locally, and responses are served from Cache
+// while fresh when it is set.
+type Resolver struct {
+	Upstreams []Upstream
+	Zones     []Zone // longest suffix first, see AddZone
+	Hosts     *Hosts
+	Block     *Blocklist
+	Cache     *Cache
+}
+
+// Zone sends queries for Suffix and its subdomains to Upstreams.
+type Zone struct {
+	Suffix    string
+	Upstreams []Upstream
+}
+
+// New creates a resolver from comma-separated upstream URLs. An upstream
+// with ?via=name is reached through dialers[name], the others directly
+// through proxy.SystemDialer.
+func New(upstreams string, dialers map[string]proxy.Dialer) (*Resolver, error) {
+	us, err := parseUpstreams(upstreams, dialers)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{Upstreams: us}, nil
+}
+
+// AddZone routes queries for suffix to comma-separated upstream URLs,
+// resolved against dialers like New.
+func (r *Resolver) AddZone(suffix, upstreams string, dialers map[string]proxy.Dialer) error {
+	us, err := parseUpstreams(upstreams, dialers)
+	if err != nil {
+		return fmt.Errorf("dns zone %s: %w", suffix, err)
+	}
+	r.Zones = append(r.Zones, Zone{Suffix: canonical(suffix), Upstreams: us})
+	sort.SliceStable(r.Zones, func(i, j int) bool {
+		return len(r.Zones[i].Suffix) > len(r.Zones[j].Suffix)
+	})
+	return nil
+}
+
+func parseUpstreams(upstreams string, dialers map[string]proxy.Dialer) ([]Upstream, error) {
+	var us []Upstream
+	for _, raw := range strings.Split(upstreams, ",") {
+		raw = strings.TrimSpace(raw)
+		dialer := proxy.SystemDialer()
+		if via := viaOf(raw); via != "" {
+			if strings.HasPrefix(raw, "udp://") {
+				return nil, fmt.Errorf("dns upstream %s: udp cannot be tunneled, use tcp://", raw)
+			}
+			if dialer = dialers[via]; dialer == nil {
+				return nil, fmt.Errorf("dns upstream %s: unknown outbound %q", raw, via)
+			}
+		}
+		u, err := NewUpstream(raw, dialer)
+		if err != nil {
+			return nil, err
+		}
+		us = append(us, u)
+	}
+	return us, nil
+}
+
+// upstreamsFor returns the upstreams responsible for name.
+func (r *Resolver) upstreamsFor(name string) []Upstream {
+	for _, z := range r.Zones {
+		if name == z.Suffix || strings.HasSuffix(name, "."+z.Suffix) {
+			return z.Upstreams
+		}
+	}
+	return r.Upstreams
+}
+
+// canonical lowercases a name and drops the trailing dot.
+func canonical(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// DirectServers returns the hosts of the comma-separated upstream URLs
+// that are dialed directly rather than through an outbound.
+func DirectServers(upstreams string) []string {
+	var hosts []string
+	for _, raw := range strings.Split(upstreams, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" || viaOf(raw) != "" {
+			continue
+		}
+		if !strings.Contains(raw, "://") {
+			raw = "udp://" + raw
+		}
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	return hosts
+}
+
+// viaOf returns the via parameter of an upstream URL.
+func viaOf(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("via")
+}
+
+// Exchange sends a query in wire format and returns the first response,
+// answering from Block and Hosts first.
+func (r *Resolver) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if resp, ok := r.AnswerLocal(query); ok {
+		return resp, nil
+	}
+	return r.Forward(ctx, query)
+}
+
+// Forward is Exchange without Block and Hosts, for callers that consulted
+// AnswerLocal themselves: the response comes from the cache or upstreams.
+func (r *Resolver) Forward(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("dns: short query")
+	}
+	key, q, ok := questionOf(query)
+	if !ok {
+		return r.exchange(ctx, r.Upstreams, query)
+	}
+	upstreams := r.upstreamsFor(key.name)
+	if r.Cache == nil {
+		return r.exchange(ctx, upstreams, query)
+	}
+	id := uint16(query[0])<<8 | uint16(query[1])
+	if resp, prefetch := r.Cache.get(key, q, id); resp != nil {
+		if prefetch {
+			go r.prefetch(upstreams, key, append([]byte(nil), query...))
+		}
+		return resp, nil
+	}
+	resp, err := r.exchange(ctx, upstreams, query)
+	if err == nil {
+		r.Cache.put(key, resp)
+	}
+	return resp, err
+}
+
+// prefetch refreshes a popular cache entry before it expires.
+func (r *Resolver) prefetch(upstreams []Upstream, key question, query []byte) {
+	if resp, err := r.exchange(context.Background(), upstreams, query); err == nil {
+		r.Cache.put(key, resp)
+	}
+	r.Cache.endPrefetch(key)
+}
+
+func (r *Resolver) exchange(ctx context.Context, upstreams []Upstream, query []byte) ([]byte, error) {
+	var errs []error
+	for _, u := range upstreams {
+		resp, err := u.Exchange(ctx, query)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", u, err))
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("dns: no upstream configured")
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,242 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yimiaoxiehou/tun2socks/proxy"
+)
+
+const (
+	// maxPipelined is how many queries may be outstanding on one connection
+	// before another one is opened.
+	maxPipelined = 32
+	// maxConns caps the connections kept open to one server.
+	maxConns = 4
+	// connIdleTimeout closes a pooled connection that saw no query for this long.
+	connIdleTimeout = 30 * time.Second
+)
+
+var errConnClosed = errors.New("dns: upstream connection closed")
+
+// tcpUpstream speaks DNS over TCP, or over TLS when tls is set. Connections
+// are kept open and queries are pipelined over them as RFC 7766 allows,
+// with responses matched by message ID.
+type tcpUpstream struct {
+	addr    string
+	timeout time.Duration
+	dialer  proxy.Dialer
+	tls     *tls.Config
+
+	mu      sync.Mutex
+	conns   []*pipeConn
+	dialing *dialCall
+}
+
+func (u *tcpUpstream) String() string {
+	if u.tls != nil {
+		return "tls://" + u.addr
+	}
+	return "tcp://" + u.addr
+}
+
+func (u *tcpUpstream) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := u.dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.tls != nil {
+		tlsConn := tls.Client(conn, u.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+func (u *tcpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	pc, reused, err := u.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := pc.exchange(ctx, query)
+	// A pooled connection may have been closed by the server while idle;
+	// retry once on a fresh one.
+	if errors.Is(err, errConnClosed) && reused && ctx.Err() == nil {
+		if pc, err = u.open(ctx); err != nil {
+			return nil, err
+		}
+		resp, err = pc.exchange(ctx, query)
+	}
+	return resp, err
+}
+
+// get returns the least loaded open connection, opening a new one when all
+// are busy and the pool is not full. Queries arriving while a connection is
+// being opened wait for it. reused reports whether it was already open.
+func (u *tcpUpstream) get(ctx context.Context) (pc *pipeConn, reused bool, err error) {
+	u.mu.Lock()
+	for _, c := range u.conns {
+		if pc == nil || c.load() < pc.load() {
+			pc = c
+		}
+	}
+	if pc != nil && (pc.load() < maxPipelined || len(u.conns) >= maxConns) {
+		u.mu.Unlock()
+		return pc, true, nil
+	}
+	if d := u.dialing; d != nil {
+		u.mu.Unlock()
+		select {
+		case <-d.done:
+			return d.pc, false, d.err
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+	d := &dialCall{done: make(chan struct{})}
+	u.dialing = d
+	u.mu.Unlock()
+
+	d.pc, d.err = u.open(ctx)
+	u.mu.Lock()
+	u.dialing = nil
+	u.mu.Unlock()
+	close(d.done)
+	return d.pc, false, d.err
+}
+
+// dialCall is a connection being opened that other queries can wait for.
+type dialCall struct {
+	done chan struct{}
+	pc   *pipeConn
+	err  error
+}
+
+// open dials a new connection and adds it to the pool.
+func (u *tcpUpstream) open(ctx context.Context) (*pipeConn, error) {
+	conn, err := u.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pc := &pipeConn{conn: conn, pending: map[uint16]chan []byte{}}
+	u.mu.Lock()
+	u.conns = append(u.conns, pc)
+	u.mu.Unlock()
+	go func() {
+		pc.readLoop()
+		u.remove(pc)
+	}()
+	return pc, nil
+}
+
+func (u *tcpUpstream) remove(pc *pipeConn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i, c := range u.conns {
+		if c == pc {
+			u.conns = append(u.conns[:i], u.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// pipeConn carries pipelined queries over one stream. Queries are sent with
+// IDs unique to the connection and given their original ID back on return.
+type pipeConn struct {
+	conn net.Conn
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint16
+	pending map[uint16]chan []byte
+	closed  bool
+}
+
+func (pc *pipeConn) load() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.pending)
+}
+
+func (pc *pipeConn) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	pc.mu.Lock()
+	if pc.closed {
+		pc.mu.Unlock()
+		return nil, errConnClosed
+	}
+	id := pc.nextID
+	for _, busy := pc.pending[id]; busy; _, busy = pc.pending[id] {
+		id++
+	}
+	pc.nextID = id + 1
+	pc.pending[id] = ch
+	pc.mu.Unlock()
+	defer func() {
+		pc.mu.Lock()
+		if pc.pending[id] == ch {
+			delete(pc.pending, id)
+		}
+		pc.mu.Unlock()
+	}()
+
+	msg := append([]byte{byte(id >> 8), byte(id)}, query[2:]...)
+	pc.wmu.Lock()
+	pc.conn.SetReadDeadline(time.Now().Add(connIdleTimeout))
+	if deadline, ok := ctx.Deadline(); ok {
+		pc.conn.SetWriteDeadline(deadline)
+	}
+	err := writeTCPMsg(pc.conn, msg)
+	pc.wmu.Unlock()
+	if err != nil {
+		pc.conn.Close()
+		return nil, errConnClosed
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, errConnClosed
+		}
+		copy(resp, query[:2])
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readLoop dispatches responses to their waiting queries until the
+// connection fails or stays idle, then fails whatever is still pending.
+func (pc *pipeConn) readLoop() {
+	for {
+		resp, err := readTCPMsg(pc.conn)
+		if err != nil {
+			break
+		}
+		id := uint16(resp[0])<<8 | uint16(resp[1])
+		pc.mu.Lock()
+		if ch, ok := pc.pending[id]; ok {
+			ch <- resp
+			delete(pc.pending, id)
+		}
+		pc.mu.Unlock()
+	}
+	pc.conn.Close()
+	pc.mu.Lock()
+	pc.closed = true
+	for id, ch := range pc.pending {
+		close(ch)
+		delete(pc.pending, id)
+	}
+	pc.mu.Unlock()
+}
@@ -0,0 +1,218 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// pipeDialer hands the server end of every connection it dials to the test.
+type pipeDialer struct {
+	conns chan net.Conn
+	dials atomic.Int32
+}
+
+func newPipeUpstream() (*tcpUpstream, *pipeDialer) {
+	d := &pipeDialer{conns: make(chan net.Conn, 8)}
+	return &tcpUpstream{addr: "192.0.2.53:53", timeout: 5 * time.Second, dialer: d}, d
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	d.dials.Add(1)
+	d.conns <- server
+	return client, nil
+}
+
+// accept returns the server end of the next dialed connection.
+func (d *pipeDialer) accept(t *testing.T) net.Conn {
+	t.Helper()
+	select {
+	case conn := <-d.conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection dialed")
+		return nil
+	}
+}
+
+func pipeQuery(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// reply answers a query received by the fake upstream by echoing it back
+// with the QR bit set.
+func reply(conn net.Conn, query []byte) error {
+	resp := append([]byte(nil), query...)
+	resp[2] |= 0x80
+	return writeTCPMsg(conn, resp)
+}
+
+// checkResponse verifies that resp answers query with the original ID.
+func checkResponse(t *testing.T, query, resp []byte) {
+	t.Helper()
+	if len(resp) != len(query) || resp[2]&0x80 == 0 {
+		t.Fatalf("response %x does not answer %x", resp, query)
+	}
+	if !bytes.Equal(resp[:2], query[:2]) || !bytes.Equal(resp[12:], query[12:]) {
+		t.Errorf("response %x, want the ID and question of %x", resp, query)
+	}
+}
+
+func TestTCPPipelining(t *testing.T) {
+	u, d := newPipeUpstream()
+	names := []string{"a.example.", "b.example.", "c.example."}
+
+	// Every query uses the same ID, so the upstream must see them rewritten.
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			query := pipeQuery(t, 0x1234, name)
+			resp, err := u.Exchange(context.Background(), query)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				return
+			}
+			checkResponse(t, query, resp)
+		}(name)
+	}
+
+	conn := d.accept(t)
+	var queries [][]byte
+	ids := map[uint16]bool{}
+	for range names {
+		q, err := readTCPMsg(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries = append(queries, q)
+		ids[uint16(q[0])<<8|uint16(q[1])] = true
+	}
+	if len(ids) != len(names) {
+		t.Errorf("upstream saw IDs %v, want %d distinct ones", ids, len(names))
+	}
+	// Answer out of order.
+	for i := len(queries) - 1; i >= 0; i-- {
+		if err := reply(conn, queries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	// The next query goes over the same connection.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q, err := readTCPMsg(conn)
+		if err == nil {
+			err = reply(conn, q)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	query := pipeQuery(t, 7, "d.example.")
+	resp, err := u.Exchange(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResponse(t, query, resp)
+	<-done
+	if n := d.dials.Load(); n != 1 {
+		t.Errorf("dialed %d connections, want 1", n)
+	}
+}
+
+func TestTCPConnLoss(t *testing.T) {
+	u, d := newPipeUpstream()
+
+	// A fresh connection lost with a query pending fails the query.
+	errc := make(chan error, 1)
+	go func() {
+		_, err := u.Exchange(context.Background(), pipeQuery(t, 1, "a.example."))
+		errc <- err
+	}()
+	conn := d.accept(t)
+	if _, err := readTCPMsg(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := <-errc; !errors.Is(err, errConnClosed) {
+		t.Errorf("got %v, want %v", err, errConnClosed)
+	}
+
+	// Open a connection to pool.
+	go func() {
+		resp, err := u.Exchange(context.Background(), pipeQuery(t, 2, "b.example."))
+		if err == nil && resp == nil {
+			err = errors.New("no response")
+		}
+		errc <- err
+	}()
+	conn = d.accept(t)
+	q, err := readTCPMsg(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reply(conn, q); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// Queries pending on a pooled connection when it is lost are retried
+	// once, each on a fresh connection.
+	names := []string{"c.example.", "d.example."}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			query := pipeQuery(t, 0x4242, name)
+			resp, err := u.Exchange(context.Background(), query)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				return
+			}
+			checkResponse(t, query, resp)
+		}(name)
+	}
+	for range names {
+		if _, err := readTCPMsg(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+	for range names {
+		conn := d.accept(t)
+		go func() {
+			if q, err := readTCPMsg(conn); err == nil {
+				reply(conn, q)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := d.dials.Load(); n != 4 {
+		t.Errorf("dialed %d connections, want 4", n)
+	}
+}
@@ -0,0 +1,215 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/yimiaoxiehou/tun2socks/proxy"
+)
+
+// defaultTimeout bounds one exchange with an upstream unless the URL sets
+// its own timeout.
+const defaultTimeout = 5 * time.Second
+
+var errIDMismatch = errors.New("dns: response id mismatch")
+
+// Upstream sends a DNS query in wire format and returns the response.
+type Upstream interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// NewUpstream creates an upstream from a URL:
+//
+//	udp://8.8.8.8:53         plain DNS, retried over TCP when truncated
+//	tcp://8.8.8.8:53         DNS over TCP
+//	tls://1.1.1.1:853        DNS over TLS, ?sni= overrides the server name
+//	https://1.1.1.1/dns-query DNS over HTTPS (RFC 8484)
+//
+// A bare address is treated as udp. Every scheme accepts ?timeout=3s.
+// Connections to the server are made through dialer; when it is a proxy
+// only the TCP based schemes can pass through it.
+func NewUpstream(rawURL string, dialer proxy.Dialer) (Upstream, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "udp://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	timeout := defaultTimeout
+	if t := u.Query().Get("timeout"); t != "" {
+		if timeout, err = time.ParseDuration(t); err != nil {
+			return nil, fmt.Errorf("dns upstream %s: invalid timeout %q", u.Redacted(), t)
+		}
+	}
+
+	switch u.Scheme {
+	case "udp":
+		addr := hostPort(u, "53")
+		return &udpUpstream{addr: addr, timeout: timeout, dialer: dialer, tcp: &tcpUpstream{addr: addr, timeout: timeout, dialer: dialer}}, nil
+	case "tcp":
+		return &tcpUpstream{addr: hostPort(u, "53"), timeout: timeout, dialer: dialer}, nil
+	case "tls":
+		serverName := u.Hostname()
+		if sni := u.Query().Get("sni"); sni != "" {
+			serverName = sni
+		}
+		return &tcpUpstream{addr: hostPort(u, "853"), timeout: timeout, dialer: dialer, tls: &tls.Config{ServerName: serverName}}, nil
+	case "https":
+		return newHTTPSUpstream(u, timeout, dialer), nil
+	}
+	return nil, fmt.Errorf("dns upstream: unknown scheme %q", u.Scheme)
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+type udpUpstream struct {
+	addr    string
+	timeout time.Duration
+	dialer  proxy.Dialer
+	tcp     *tcpUpstream
+}
+
+func (u *udpUpstream) String() string {
+	return "udp://" + u.addr
+}
+
+func (u *udpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+	conn, err := u.dialer.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray datagrams that do not answer this query.
+		if n < 12 || !bytes.Equal(buf[:2], query[:2]) {
+			continue
+		}
+		if truncated(buf[:n]) {
+			return u.tcp.Exchange(ctx, query)
+		}
+		return buf[:n], nil
+	}
+}
+
+// truncated reports whether the TC bit of a response is set.
+func truncated(resp []byte) bool {
+	return len(resp) > 2 && resp[2]&0x02 != 0
+}
+
+// writeTCPMsg sends a message with its two-byte length prefix.
+func writeTCPMsg(w io.Writer, msg []byte) error {
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+// readTCPMsg reads one length-prefixed message.
+func readTCPMsg(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length < 12 {
+		return nil, fmt.Errorf("dns: short message of %d bytes", length)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// httpsUpstream speaks DNS over HTTPS with POST requests.
+type httpsUpstream struct {
+	url     string
+	timeout time.Duration
+	client  *http.Client
+}
+
+func newHTTPSUpstream(u *url.URL, timeout time.Duration, dialer proxy.Dialer) *httpsUpstream {
+	endpoint := *u
+	query := endpoint.Query()
+	query.Del("timeout")
+	query.Del("via")
+	endpoint.RawQuery = query.Encode()
+	if endpoint.Path == "" {
+		endpoint.Path = "/dns-query"
+	}
+	return &httpsUpstream{
+		url:     endpoint.String(),
+		timeout: timeout,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:       dialer.DialContext,
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		},
+	}
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	// RFC 8484 recommends ID 0 so responses are cacheable.
+	msg := append([]byte{0, 0}, query[2:]...)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns upstream %s: %s", u.url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 12 {
+		return nil, fmt.Errorf("dns upstream %s: short response", u.url)
+	}
+	copy(body, query[:2])
+	return body, nil
+}
@@ -0,0 +1,266 @@
+// Package rule decides per flow whether it is proxied, sent directly or
+// rejected, based on an ordered list of rules where the first match wins.
+//
+// A rules file holds one rule per line: an action followed by matchers.
+//
+//	# action      matchers (all must match, a missing matcher matches anything)
+//	direct        dst=192.168.0.0/16,10.0.0.0/8
+//	reject        proto=tcp port=25
+//	proxy:corp    dst=172.16.0.0/12 port=443,8000-8999 src=10.10.10.0/24
+//	proxy:corp    domain=corp.example,internal.example
+//	proxy
+//
+// domain matches the name and all its subdomains. The name of a flow is
+// known when it comes from fake-ip DNS or from sniffing its first bytes.
+//
+// Actions are proxy (the default outbound), proxy:<name>, direct and reject.
+// Flows matching no rule use the default outbound.
+package rule
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Action kinds.
+const (
+	Proxy  = "proxy"
+	Direct = "direct"
+	Reject = "reject"
+)
+
+// Action is what happens to a matching flow. Outbound names the proxy for
+// proxy:<name> and is empty for the default outbound.
+type Action struct {
+	Kind     string
+	Outbound string
+}
+
+func (a Action) String() string {
+	if a.Kind == Proxy && a.Outbound != "" {
+		return Proxy + ":" + a.Outbound
+	}
+	return a.Kind
+}
+
+// Metadata describes the flow being matched.
+type Metadata struct {
+	Network string // "tcp" or "udp"
+	Src     netip.AddrPort
+	Dst     netip.AddrPort
+	Domain  string // destination hostname, empty if unknown
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From, To uint16
+}
+
+// Rule matches flows on destination, source, port and protocol.
+type Rule struct {
+	Action  Action
+	Network string
+	Dst     []netip.Prefix
+	Src     []netip.Prefix
+	Ports   []PortRange
+	Domains []string
+}
+
+// Match reports whether every matcher of r accepts m.
+func (r *Rule) Match(m *Metadata) bool {
+	if r.Network != "" && r.Network != m.Network {
+		return false
+	}
+	if len(r.Dst) > 0 && !matchPrefix(r.Dst, m.Dst.Addr()) {
+		return false
+	}
+	if len(r.Src) > 0 && !matchPrefix(r.Src, m.Src.Addr()) {
+		return false
+	}
+	if len(r.Domains) > 0 && !matchDomain(r.Domains, m.Domain) {
+		return false
+	}
+	if len(r.Ports) > 0 {
+		port := m.Dst.Port()
+		for _, pr := range r.Ports {
+			if port >= pr.From && port <= pr.To {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchPrefix(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain reports whether name equals or is a subdomain of a suffix.
+func matchDomain(suffixes []string, name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "" {
+		return false
+	}
+	for _, suffix := range suffixes {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Set is an ordered rule list.
+type Set struct {
+	Rules []*Rule
+}
+
+// Match returns the action of the first rule matching m, or the default
+// proxy when none does.
+func (s *Set) Match(m *Metadata) Action {
+	if s != nil {
+		for _, r := range s.Rules {
+			if r.Match(m) {
+				return r.Action
+			}
+		}
+	}
+	return Action{Kind: Proxy}
+}
+
+// Load reads a rules file.
+func Load(path string) (*Set, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Parse reads rules in the file format described in the package comment.
+func Parse(r io.Reader) (*Set, error) {
+	s := &Set{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		rule, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("rule line %d: %v", line, err)
+		}
+		s.Rules = append(s.Rules, rule)
+	}
+	return s, scanner.Err()
+}
+
+func parseRule(fields []string) (*Rule, error) {
+	r := &Rule{}
+	action, err := ParseAction(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	r.Action = action
+
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid matcher %q, want key=value", field)
+		}
+		switch key {
+		case "dst":
+			if r.Dst, err = parsePrefixes(value); err != nil {
+				return nil, err
+			}
+		case "src":
+			if r.Src, err = parsePrefixes(value); err != nil {
+				return nil, err
+			}
+		case "port":
+			if r.Ports, err = parsePorts(value); err != nil {
+				return nil, err
+			}
+		case "domain":
+			for _, d := range strings.Split(value, ",") {
+				r.Domains = append(r.Domains, strings.Trim(strings.ToLower(d), "."))
+			}
+		case "proto":
+			if value != "tcp" && value != "udp" {
+				return nil, fmt.Errorf("unknown proto %q", value)
+			}
+			r.Network = value
+		default:
+			return nil, fmt.Errorf("unknown matcher %q", key)
+		}
+	}
+	return r, nil
+}
+
+// ParseAction parses proxy, proxy:<name>, direct or reject.
+func ParseAction(s string) (Action, error) {
+	kind, name, _ := strings.Cut(s, ":")
+	switch kind {
+	case Proxy:
+		return Action{Kind: Proxy, Outbound: name}, nil
+	case Direct, Reject:
+		if name == "" {
+			return Action{Kind: kind}, nil
+		}
+	}
+	return Action{}, fmt.Errorf("unknown action %q", s)
+}
+
+// parsePrefixes parses a comma-separated list of CIDRs or single addresses.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(s, ",") {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// parsePorts parses a comma-separated list of ports and from-to ranges.
+func parsePorts(s string) ([]PortRange, error) {
+	var ports []PortRange
+	for _, item := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(item, "-")
+		lo, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.ParseUint(to, 10, 16); err != nil || hi < lo {
+				return nil, fmt.Errorf("invalid port range %q", item)
+			}
+		}
+		ports = append(ports, PortRange{From: uint16(lo), To: uint16(hi)})
+	}
+	return ports, nil
+}
@@ -0,0 +1,178 @@
+package rule
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+const testRules = `
+# comments and blank lines are skipped
+
+reject        proto=tcp port=25
+direct        dst=192.168.0.0/16,10.0.0.0/8   # LAN
+proxy:media   dst=2001:db8::/32 port=443,8000-8999 src=10.10.10.0/24
+direct        dst=203.0.113.7 proto=udp
+proxy:final
+`
+
+func TestMatch(t *testing.T) {
+	s, err := Parse(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Rules) != 5 {
+		t.Fatalf("parsed %d rules, want 5", len(s.Rules))
+	}
+
+	tests := []struct {
+		name   string
+		meta   Metadata
+		action string
+	}{
+		{"port and proto", meta("tcp", "10.10.10.2:5000", "198.51.100.1:25"), "reject"},
+		{"port other proto", meta("udp", "10.10.10.2:5000", "198.51.100.1:25"), "proxy:final"},
+		{"first match wins", meta("tcp", "10.10.10.2:5000", "192.168.1.1:25"), "reject"},
+		{"cidr", meta("udp", "10.10.10.2:5000", "10.1.2.3:53"), "direct"},
+		{"cidr mapped address", meta("tcp", "10.10.10.2:5000", "[::ffff:192.168.3.4]:80"), "direct"},
+		{"all matchers", meta("tcp", "10.10.10.9:5000", "[2001:db8::1]:443"), "proxy:media"},
+		{"port range", meta("tcp", "10.10.10.9:5000", "[2001:db8::1]:8999"), "proxy:media"},
+		{"port outside range", meta("tcp", "10.10.10.9:5000", "[2001:db8::1]:9000"), "proxy:final"},
+		{"src mismatch", meta("tcp", "10.10.11.9:5000", "[2001:db8::1]:443"), "proxy:final"},
+		{"single address", meta("udp", "10.10.10.2:5000", "203.0.113.7:123"), "direct"},
+		{"single address other host", meta("udp", "10.10.10.2:5000", "203.0.113.8:123"), "proxy:final"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.Match(&tt.meta).String(); got != tt.action {
+				t.Errorf("Match = %s, want %s", got, tt.action)
+			}
+		})
+	}
+}
+
+func meta(network, src, dst string) Metadata {
+	return Metadata{
+		Network: network,
+		Src:     netip.MustParseAddrPort(src),
+		Dst:     netip.MustParseAddrPort(dst),
+	}
+}
+
+func TestMatchDefault(t *testing.T) {
+	m := meta("tcp", "10.10.10.2:5000", "192.0.2.1:80")
+	s, err := Parse(strings.NewReader("direct dst=10.0.0.0/8\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No rule matching, an empty set and a nil set all use the default proxy.
+	for _, s := range []*Set{s, {}, nil} {
+		if got := s.Match(&m); got != (Action{Kind: Proxy}) {
+			t.Errorf("Match = %s, want the default proxy", got)
+		}
+	}
+}
+
+func TestParseAction(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Action
+		wantErr bool
+	}{
+		{"proxy", Action{Kind: Proxy}, false},
+		{"proxy:corp", Action{Kind: Proxy, Outbound: "corp"}, false},
+		{"direct", Action{Kind: Direct}, false},
+		{"reject", Action{Kind: Reject}, false},
+		{"direct:x", Action{}, true},
+		{"reject:x", Action{}, true},
+		{"drop", Action{}, true},
+		{"Proxy", Action{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAction(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseAction(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		line string
+	}{
+		{"unknown action", "proxy\nforward dst=10.0.0.0/8\n", "line 2"},
+		{"no value", "direct dst\n", "line 1"},
+		{"empty value", "direct dst=\n", "line 1"},
+		{"unknown matcher", "direct host=example.com\n", "line 1"},
+		{"bad cidr", "direct dst=10.0.0.0/33\n", "line 1"},
+		{"bad address", "direct src=10.0.0\n", "line 1"},
+		{"bad port", "direct port=http\n", "line 1"},
+		{"port too large", "direct port=65536\n", "line 1"},
+		{"reversed range", "direct port=90-80\n", "line 1"},
+		{"open range", "direct port=80-\n", "line 1"},
+		{"unknown proto", "# icmp\n\ndirect proto=icmp\n", "line 3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.text))
+			if err == nil || !strings.Contains(err.Error(), tt.line) {
+				t.Errorf("Parse = %v, want an error on %s", err, tt.line)
+			}
+		})
+	}
+}
+
+func TestParseMatchers(t *testing.T) {
+	s, err := Parse(strings.NewReader("direct dst=10.1.2.3/8,::ffff:192.0.2.1 port=53,100-200"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := s.Rules[0]
+	// Prefixes are masked and mapped addresses unmapped.
+	wantDst := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.1/32")}
+	if len(r.Dst) != 2 || r.Dst[0] != wantDst[0] || r.Dst[1] != wantDst[1] {
+		t.Errorf("Dst = %v, want %v", r.Dst, wantDst)
+	}
+	wantPorts := []PortRange{{53, 53}, {100, 200}}
+	if len(r.Ports) != 2 || r.Ports[0] != wantPorts[0] || r.Ports[1] != wantPorts[1] {
+		t.Errorf("Ports = %v, want %v", r.Ports, wantPorts)
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	s, err := Parse(strings.NewReader("proxy:corp domain=Corp.Example.,internal.example\ndirect domain=lan port=80\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		domain string
+		port   uint16
+		action string
+	}{
+		{"corp.example", 443, "proxy:corp"},
+		{"git.CORP.example.", 443, "proxy:corp"},
+		{"a.b.internal.example", 443, "proxy:corp"},
+		{"notcorp.example", 443, "proxy"},
+		{"corp.example.org", 443, "proxy"},
+		{"nas.lan", 80, "direct"},
+		{"nas.lan", 443, "proxy"},
+		// A flow without a known name matches no domain rule.
+		{"", 80, "proxy"},
+	}
+	for _, tt := range tests {
+		m := Metadata{
+			Network: "tcp",
+			Src:     netip.MustParseAddrPort("10.10.10.2:5000"),
+			Dst:     netip.AddrPortFrom(netip.MustParseAddr("198.18.0.5"), tt.port),
+			Domain:  tt.domain,
+		}
+		if got := s.Match(&m).String(); got != tt.action {
+			t.Errorf("Match(%q port %d) = %s, want %s", tt.domain, tt.port, got, tt.action)
+		}
+	}
+	if d := s.Rules[0].Domains; len(d) != 2 || d[0] != "corp.example" {
+		t.Errorf("Domains = %q, want them lowercased without the trailing dot", d)
+	}
+}
@@ -0,0 +1,82 @@
+// Package shadowsocks implements the client side of the Shadowsocks AEAD
+// protocol: TCP stream framing and UDP packet encryption.
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Cipher holds the master key of an AEAD method. Each stream and packet
+// derives its own subkey from the master key and a random salt.
+type Cipher struct {
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// NewCipher returns the cipher for method, deriving the master key from
+// password the same way as the reference implementation (EVP_BytesToKey).
+func NewCipher(method, password string) (*Cipher, error) {
+	switch strings.ToLower(method) {
+	case "chacha20-ietf-poly1305":
+		return &Cipher{key: kdf(password, chacha20poly1305.KeySize), newAEAD: chacha20poly1305.New}, nil
+	case "aes-256-gcm":
+		return &Cipher{key: kdf(password, 32), newAEAD: newGCM}, nil
+	}
+	return nil, fmt.Errorf("shadowsocks: unsupported method %q", method)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SaltSize is the length of the salt prefixed to every stream and packet.
+// It always equals the key size for the supported methods.
+func (c *Cipher) SaltSize() int {
+	return len(c.key)
+}
+
+// aead derives the session subkey for salt with HKDF-SHA1.
+func (c *Cipher) aead(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+// kdf is OpenSSL's EVP_BytesToKey with MD5 and no salt.
+func kdf(password string, keyLen int) []byte {
+	var b, prev []byte
+	h := md5.New()
+	for len(b) < keyLen {
+		h.Write(prev)
+		h.Write([]byte(password))
+		b = h.Sum(b)
+		prev = b[len(b)-h.Size():]
+		h.Reset()
+	}
+	return b[:keyLen]
+}
+
+// increment treats b as a little-endian counter.
+func increment(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
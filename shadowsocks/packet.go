@@ -0,0 +1,91 @@
+package shadowsocks
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+
+	"github.com/yimiaoxiehou/tun2socks/socks"
+)
+
+var errShortPacket = errors.New("shadowsocks: short packet")
+
+// PacketConn encrypts datagrams exchanged with a Shadowsocks server:
+//
+//	[salt][encrypted target address + payload][tag]
+//
+// Every packet uses a fresh salt and a zero nonce.
+type PacketConn struct {
+	net.PacketConn
+	server net.Addr
+	cipher *Cipher
+}
+
+// NewPacketConn sends and receives through pc, addressing server.
+func NewPacketConn(pc net.PacketConn, server net.Addr, c *Cipher) *PacketConn {
+	return &PacketConn{PacketConn: pc, server: server, cipher: c}
+}
+
+// WriteTo sends b to addr through the server.
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst, ok := addr.(*socks.Addr)
+	if !ok {
+		var err error
+		if dst, err = socks.ParseAddr(addr.String()); err != nil {
+			return 0, err
+		}
+	}
+	salt := make([]byte, c.cipher.SaltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return 0, err
+	}
+	aead, err := c.cipher.aead(salt)
+	if err != nil {
+		return 0, err
+	}
+	plain := append(dst.AppendTo(nil), b...)
+	pkt := aead.Seal(salt, make([]byte, aead.NonceSize()), plain, nil)
+	if _, err := c.PacketConn.WriteTo(pkt, c.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom returns the next datagram and the remote address it came from.
+// Packets that fail to decrypt are dropped.
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		plain, err := c.open(buf[:n])
+		if err != nil {
+			continue
+		}
+		src, l, err := socks.SplitAddr(plain)
+		if err != nil {
+			continue
+		}
+		if udpAddr := src.UDPAddr(); udpAddr != nil {
+			return copy(b, plain[l:]), udpAddr, nil
+		}
+		return copy(b, plain[l:]), src, nil
+	}
+}
+
+func (c *PacketConn) open(pkt []byte) ([]byte, error) {
+	saltSize := c.cipher.SaltSize()
+	if len(pkt) < saltSize {
+		return nil, errShortPacket
+	}
+	aead, err := c.cipher.aead(pkt[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	if len(pkt) < saltSize+aead.Overhead() {
+		return nil, errShortPacket
+	}
+	return aead.Open(pkt[saltSize:saltSize], make([]byte, aead.NonceSize()), pkt[saltSize:], nil)
+}
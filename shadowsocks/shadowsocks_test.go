@@ -0,0 +1,240 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/yimiaoxiehou/tun2socks/socks"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestKDF(t *testing.T) {
+	tests := []struct {
+		password string
+		keyLen   int
+		want     string
+	}{
+		// The first block is MD5(password).
+		{"password", 16, "5f4dcc3b5aa765d61d8327deb882cf99"},
+		{"barfoo!", 32, "b3adc47839e047eb228870526dc8fc30b347287ffca3045dcea06b3fdf090acb"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(kdf(tt.password, tt.keyLen)); got != tt.want {
+			t.Errorf("kdf(%q, %d) = %s, want %s", tt.password, tt.keyLen, got, tt.want)
+		}
+	}
+}
+
+// testSalt and testSubkey are the HKDF-SHA1 "ss-subkey" derivation of the
+// "barfoo!" master key.
+var (
+	testSalt   = unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	testSubkey = unhex("6e62f41174d7879ffea269ebf7805b730f62002e2b461f4dcb2a21dfb6f6423e")
+)
+
+func TestSubkey(t *testing.T) {
+	for _, method := range []string{"chacha20-ietf-poly1305", "aes-256-gcm"} {
+		c, err := NewCipher(method, "barfoo!")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.aead(testSalt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := c.newAEAD(testSubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := make([]byte, want.NonceSize())
+		if !bytes.Equal(got.Seal(nil, nonce, []byte("x"), nil), want.Seal(nil, nonce, []byte("x"), nil)) {
+			t.Errorf("%s: subkey differs from the HKDF-SHA1 vector", method)
+		}
+	}
+	if _, err := NewCipher("rc4-md5", "barfoo!"); err == nil {
+		t.Error("NewCipher accepted a stream cipher")
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	tests := []struct{ in, want []byte }{
+		{[]byte{0, 0, 0}, []byte{1, 0, 0}},
+		{[]byte{0xff, 0, 0}, []byte{0, 1, 0}},
+		{[]byte{0xff, 0xff, 0xff}, []byte{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		b := append([]byte(nil), tt.in...)
+		if increment(b); !bytes.Equal(b, tt.want) {
+			t.Errorf("increment(%x) = %x, want %x", tt.in, b, tt.want)
+		}
+	}
+}
+
+// sealChunks frames payloads as a server would, with the subkey of
+// testSalt and nonces counting up from zero.
+func sealChunks(t *testing.T, aead cipher.AEAD, payloads ...[]byte) []byte {
+	t.Helper()
+	nonce := make([]byte, aead.NonceSize())
+	out := append([]byte(nil), testSalt...)
+	for _, p := range payloads {
+		out = aead.Seal(out, nonce, binary.BigEndian.AppendUint16(nil, uint16(len(p))), nil)
+		increment(nonce)
+		out = aead.Seal(out, nonce, p, nil)
+		increment(nonce)
+	}
+	return out
+}
+
+// pipeConn serves the bytes of r to Read and discards writes.
+type pipeConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func TestConnRead(t *testing.T) {
+	c, _ := NewCipher("chacha20-ietf-poly1305", "barfoo!")
+	aead, _ := chacha20poly1305.New(testSubkey)
+
+	tests := []struct {
+		name    string
+		stream  func() []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "chunks",
+			stream: func() []byte { return sealChunks(t, aead, []byte("hello, "), []byte("world")) },
+			want:   "hello, world",
+		},
+		{
+			name: "tampered",
+			stream: func() []byte {
+				b := sealChunks(t, aead, []byte("hello"))
+				b[len(b)-1] ^= 1
+				return b
+			},
+			wantErr: true,
+		},
+		{
+			name:    "empty chunk",
+			stream:  func() []byte { return sealChunks(t, aead, []byte{}) },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := NewConn(&pipeConn{r: bytes.NewReader(tt.stream())}, c)
+			got, err := io.ReadAll(conn)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("read %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnRoundTrip(t *testing.T) {
+	for _, method := range []string{"chacha20-ietf-poly1305", "aes-256-gcm"} {
+		t.Run(method, func(t *testing.T) {
+			c, _ := NewCipher(method, "barfoo!")
+			client, server := net.Pipe()
+			defer client.Close()
+
+			// Larger than one chunk, so Write splits it.
+			want := bytes.Repeat([]byte("0123456789abcdef"), 3000)
+			go func() {
+				NewConn(client, c).Write(want)
+				client.Close()
+			}()
+			got, err := io.ReadAll(NewConn(server, c))
+			if err != nil && !errors.Is(err, io.EOF) {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("read %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+// capturePacketConn records the last datagram written and serves reads
+// from in.
+type capturePacketConn struct {
+	net.PacketConn
+	out []byte
+	in  [][]byte
+}
+
+func (c *capturePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.out = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (c *capturePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(c.in) == 0 {
+		return 0, nil, io.EOF
+	}
+	n := copy(b, c.in[0])
+	c.in = c.in[1:]
+	return n, nil, nil
+}
+
+func TestPacket(t *testing.T) {
+	c, _ := NewCipher("chacha20-ietf-poly1305", "barfoo!")
+	aead, _ := chacha20poly1305.New(testSubkey)
+	src, _ := socks.ParseAddr("192.0.2.1:53")
+	nonce := make([]byte, aead.NonceSize())
+	reply := aead.Seal(append([]byte(nil), testSalt...), nonce, append(src.AppendTo(nil), "answer"...), nil)
+	tampered := append([]byte(nil), reply...)
+	tampered[len(tampered)-1] ^= 1
+
+	// ReadFrom skips packets that are short or fail to decrypt.
+	pc := &capturePacketConn{in: [][]byte{testSalt[:4], tampered, reply}}
+	conn := NewPacketConn(pc, nil, c)
+	buf := make([]byte, 64)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "answer" || addr.String() != "192.0.2.1:53" {
+		t.Errorf("ReadFrom = %q from %s, want \"answer\" from 192.0.2.1:53", buf[:n], addr)
+	}
+
+	dst, _ := socks.ParseAddr("example.com:443")
+	if _, err := conn.WriteTo([]byte("query"), dst); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := conn.open(pc.out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(dst.AppendTo(nil), "query"...)
+	if !bytes.Equal(plain, want) {
+		t.Errorf("sent %x, want %x", plain, want)
+	}
+}
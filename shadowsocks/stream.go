@@ -0,0 +1,125 @@
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// maxPayload is the largest payload carried by one chunk.
+const maxPayload = 0x3FFF
+
+var errChunkLength = errors.New("shadowsocks: invalid chunk length")
+
+// Conn encrypts a TCP stream with the AEAD chunk framing:
+//
+//	[salt][encrypted length][length tag][encrypted payload][payload tag]...
+//
+// The two directions use independent salts, subkeys and nonces.
+type Conn struct {
+	net.Conn
+	cipher *Cipher
+
+	enc      cipher.AEAD
+	encNonce []byte
+	wbuf     []byte
+
+	dec      cipher.AEAD
+	decNonce []byte
+	rbuf     []byte
+	leftover []byte
+}
+
+// NewConn wraps conn, which must be connected to a Shadowsocks server.
+func NewConn(conn net.Conn, c *Cipher) *Conn {
+	return &Conn{Conn: conn, cipher: c}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		salt := make([]byte, c.cipher.SaltSize())
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.cipher.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.enc = aead
+		c.encNonce = make([]byte, aead.NonceSize())
+		c.wbuf = append(make([]byte, 0, len(salt)+2+maxPayload+2*aead.Overhead()), salt...)
+	}
+
+	n := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxPayload {
+			chunk = chunk[:maxPayload]
+		}
+		buf := c.wbuf
+		buf = c.enc.Seal(buf, c.encNonce, binary.BigEndian.AppendUint16(nil, uint16(len(chunk))), nil)
+		increment(c.encNonce)
+		buf = c.enc.Seal(buf, c.encNonce, chunk, nil)
+		increment(c.encNonce)
+		if _, err := c.Conn.Write(buf); err != nil {
+			return n, err
+		}
+		c.wbuf = c.wbuf[:0]
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.leftover) > 0 {
+		n := copy(b, c.leftover)
+		c.leftover = c.leftover[n:]
+		return n, nil
+	}
+
+	if c.dec == nil {
+		salt := make([]byte, c.cipher.SaltSize())
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.cipher.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.dec = aead
+		c.decNonce = make([]byte, aead.NonceSize())
+		c.rbuf = make([]byte, maxPayload+aead.Overhead())
+	}
+
+	overhead := c.dec.Overhead()
+	buf := c.rbuf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return 0, err
+	}
+	if _, err := c.dec.Open(buf[:0], c.decNonce, buf, nil); err != nil {
+		return 0, err
+	}
+	increment(c.decNonce)
+	size := int(binary.BigEndian.Uint16(buf) & maxPayload)
+	if size == 0 {
+		return 0, errChunkLength
+	}
+
+	buf = c.rbuf[:size+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return 0, err
+	}
+	payload, err := c.dec.Open(buf[:0], c.decNonce, buf, nil)
+	if err != nil {
+		return 0, err
+	}
+	increment(c.decNonce)
+
+	n := copy(b, payload)
+	c.leftover = payload[n:]
+	return n, nil
+}
@@ -0,0 +1,56 @@
+package sniff
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE ", "CONNECT "}
+
+// HTTPHost extracts the Host header of an HTTP/1.x request, without port.
+// Address literals are reported as ErrNoName.
+func HTTPHost(b []byte) (string, error) {
+	if !isHTTPRequest(b) {
+		return "", ErrNotMatch
+	}
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		return "", ErrIncomplete
+	}
+	lines := strings.Split(string(b[:end]), "\r\n")
+	if !strings.HasPrefix(lines[0][strings.LastIndexByte(lines[0], ' ')+1:], "HTTP/1.") {
+		return "", ErrNotMatch
+	}
+	for _, line := range lines[1:] {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), "Host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		// An address literal tells nothing beyond the destination IP.
+		if host == "" || net.ParseIP(host) != nil {
+			break
+		}
+		return host, nil
+	}
+	return "", ErrNoName
+}
+
+// isHTTPRequest reports whether b starts, or could start, with a method.
+func isHTTPRequest(b []byte) bool {
+	for _, m := range httpMethods {
+		n := len(b)
+		if n > len(m) {
+			n = len(m)
+		}
+		if string(b[:n]) == m[:n] {
+			return n > 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,266 @@
+package sniff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// QUIC versions whose Initial packets can be decrypted.
+const (
+	quicVersion1 = 0x00000001
+	quicVersion2 = 0x6b3343cf
+)
+
+var (
+	// Initial salts from RFC 9001 section 5.2 and RFC 9369 section 3.3.1.
+	quicSaltV1 = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	quicSaltV2 = []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9}
+
+	errQUICMalformed = errors.New("sniff: malformed QUIC Initial packet")
+)
+
+// maxQUICCrypto bounds the reassembled CRYPTO data kept per session.
+const maxQUICCrypto = 16 * 1024
+
+// QUICSniffer reassembles the ClientHello from the Initial packets at the
+// start of a QUIC connection. A ClientHello with large key shares spans
+// several packets, so datagrams are fed one by one until Feed stops
+// returning ErrIncomplete.
+type QUICSniffer struct {
+	frames map[uint64][]byte
+	size   int
+}
+
+// QUICServerName extracts the SNI from a single datagram.
+func QUICServerName(datagram []byte) (string, error) {
+	var s QUICSniffer
+	return s.Feed(datagram)
+}
+
+// Feed decrypts the client Initial packets coalesced in datagram and tries
+// to parse the ClientHello from all CRYPTO data seen so far.
+func (s *QUICSniffer) Feed(datagram []byte) (string, error) {
+	if s.frames == nil {
+		s.frames = map[uint64][]byte{}
+	}
+	found := false
+	for len(datagram) > 0 {
+		payload, rest, err := openInitial(datagram)
+		if err == ErrNotMatch && found {
+			// Later coalesced packets such as 0-RTT are not needed.
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		found = true
+		if err := s.readFrames(payload); err != nil {
+			return "", err
+		}
+		datagram = rest
+	}
+
+	hello := s.contiguous()
+	if len(hello) < 4 {
+		return "", ErrIncomplete
+	}
+	return ClientHelloServerName(hello)
+}
+
+// contiguous returns the CRYPTO data available from offset 0 without gaps.
+func (s *QUICSniffer) contiguous() []byte {
+	offsets := make([]uint64, 0, len(s.frames))
+	for off := range s.frames {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	var data []byte
+	for _, off := range offsets {
+		if off > uint64(len(data)) {
+			break
+		}
+		if end := off + uint64(len(s.frames[off])); end > uint64(len(data)) {
+			data = append(data, s.frames[off][uint64(len(data))-off:]...)
+		}
+	}
+	return data
+}
+
+// readFrames collects the CRYPTO frames of a decrypted Initial payload.
+func (s *QUICSniffer) readFrames(b []byte) error {
+	for len(b) > 0 {
+		typ, n := quicVarint(b)
+		if n == 0 {
+			return errQUICMalformed
+		}
+		b = b[n:]
+		switch typ {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x02, 0x03: // ACK
+			var fields [4]uint64
+			for i := range fields {
+				if fields[i], n = quicVarint(b); n == 0 {
+					return errQUICMalformed
+				}
+				b = b[n:]
+			}
+			// Each additional range holds a gap and a length.
+			skip := 2 * fields[2]
+			if typ == 0x03 {
+				skip += 3 // ECN counts
+			}
+			for ; skip > 0; skip-- {
+				if _, n = quicVarint(b); n == 0 {
+					return errQUICMalformed
+				}
+				b = b[n:]
+			}
+		case 0x06: // CRYPTO
+			off, n1 := quicVarint(b)
+			if n1 == 0 {
+				return errQUICMalformed
+			}
+			length, n2 := quicVarint(b[n1:])
+			if n2 == 0 || uint64(len(b)-n1-n2) < length {
+				return errQUICMalformed
+			}
+			data := b[n1+n2 : n1+n2+int(length)]
+			b = b[n1+n2+int(length):]
+			if s.size+len(data) > maxQUICCrypto {
+				return errQUICMalformed
+			}
+			s.size += len(data)
+			s.frames[off] = append([]byte(nil), data...)
+		case 0x1c: // CONNECTION_CLOSE
+			return ErrNotMatch
+		default:
+			return errQUICMalformed
+		}
+	}
+	return nil
+}
+
+// openInitial removes header protection from the client Initial packet at
+// the start of b and decrypts it. It returns the frames and whatever
+// follows the packet in the datagram.
+func openInitial(b []byte) (payload, rest []byte, err error) {
+	// Long header with the fixed bit set.
+	if len(b) < 7 || b[0]&0xc0 != 0xc0 {
+		return nil, nil, ErrNotMatch
+	}
+	version := binary.BigEndian.Uint32(b[1:5])
+	var salt []byte
+	var label string
+	var initialType byte
+	switch version {
+	case quicVersion1:
+		salt, label, initialType = quicSaltV1, "quic", 0
+	case quicVersion2:
+		salt, label, initialType = quicSaltV2, "quicv2", 1
+	default:
+		return nil, nil, ErrNotMatch
+	}
+	if (b[0]>>4)&0x03 != initialType {
+		return nil, nil, ErrNotMatch
+	}
+
+	r := reader(b[5:])
+	dcid, ok := r.vector(1)
+	if !ok || len(dcid) > 20 || !r.skipVector(1) {
+		return nil, nil, errQUICMalformed
+	}
+	tokenLen, n := quicVarint(r)
+	if n == 0 || uint64(len(r)-n) < tokenLen {
+		return nil, nil, errQUICMalformed
+	}
+	r = r[n+int(tokenLen):]
+	length, n := quicVarint(r)
+	if n == 0 || uint64(len(r)-n) < length {
+		return nil, nil, errQUICMalformed
+	}
+	pnOffset := len(b) - len(r) + n
+	end := pnOffset + int(length)
+	// The header protection sample starts 4 bytes after the packet number.
+	if end < pnOffset+4+16 {
+		return nil, nil, errQUICMalformed
+	}
+
+	key, iv, hp := initialKeys(dcid, salt, label)
+
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, nil, err
+	}
+	mask := make([]byte, 16)
+	hpBlock.Encrypt(mask, b[pnOffset+4:pnOffset+20])
+
+	header := append([]byte(nil), b[:pnOffset+4]...)
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	header = header[:pnOffset+pnLen]
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		nonce[len(nonce)-pnLen+i] ^= header[pnOffset+i]
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err = aead.Open(nil, nonce, b[pnOffset+pnLen:end], header)
+	if err != nil {
+		return nil, nil, ErrNotMatch
+	}
+	return payload, b[end:], nil
+}
+
+// initialKeys derives the client Initial packet protection keys from the
+// Destination Connection ID the client chose.
+func initialKeys(dcid, salt []byte, label string) (key, iv, hp []byte) {
+	secret := hkdf.Extract(sha256.New, dcid, salt)
+	clientSecret := expandLabel(secret, "client in", 32)
+	return expandLabel(clientSecret, label+" key", 16),
+		expandLabel(clientSecret, label+" iv", 12),
+		expandLabel(clientSecret, label+" hp", 16)
+}
+
+// expandLabel is HKDF-Expand-Label from TLS 1.3 with an empty context.
+func expandLabel(secret []byte, label string, length int) []byte {
+	info := binary.BigEndian.AppendUint16(nil, uint16(length))
+	info = append(info, byte(len("tls13 "+label)))
+	info = append(info, "tls13 "+label...)
+	info = append(info, 0)
+	out := make([]byte, length)
+	io.ReadFull(hkdf.Expand(sha256.New, secret, info), out)
+	return out
+}
+
+// quicVarint decodes a variable-length integer, returning its value and
+// size, or a size of 0 when b is too short.
+func quicVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n
+}
@@ -0,0 +1,230 @@
+package sniff
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// testDCID is the Destination Connection ID of the client Initial packets
+// in RFC 9001 appendix A and RFC 9369 appendix A.
+var testDCID = unhex("8394c8f03e515708")
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// quicKeys are the client Initial keys for testDCID given by the RFCs.
+var quicKeys = []struct {
+	name    string
+	version uint32
+	salt    []byte
+	label   string
+	key     string
+	iv      string
+	hp      string
+}{
+	{"v1", quicVersion1, quicSaltV1, "quic", "1f369613dd76d5467730efcbe3b1a22d", "fa044b2f42a3fd3b46fb255c", "9f50449e04a0e810283a1e9933adedd2"},
+	{"v2", quicVersion2, quicSaltV2, "quicv2", "8b1a0bc121284290a29e0971b5cd045d", "91f73e2351d8fa91660e909f", "45b95e15235d6f45a6b19cbcb0294ba9"},
+}
+
+func TestQUICInitialKeys(t *testing.T) {
+	for _, tt := range quicKeys {
+		t.Run(tt.name, func(t *testing.T) {
+			key, iv, hp := initialKeys(testDCID, tt.salt, tt.label)
+			if got := hex.EncodeToString(key); got != tt.key {
+				t.Errorf("key = %s, want %s", got, tt.key)
+			}
+			if got := hex.EncodeToString(iv); got != tt.iv {
+				t.Errorf("iv = %s, want %s", got, tt.iv)
+			}
+			if got := hex.EncodeToString(hp); got != tt.hp {
+				t.Errorf("hp = %s, want %s", got, tt.hp)
+			}
+		})
+	}
+}
+
+func TestQUICVarint(t *testing.T) {
+	// RFC 9000 appendix A.1
+	tests := []struct {
+		in   string
+		want uint64
+		n    int
+	}{
+		{"c2197c5eff14e88c", 151288809941952652, 8},
+		{"9d7f3e7d", 494878333, 4},
+		{"7bbd", 15293, 2},
+		{"25", 37, 1},
+		{"4025", 37, 2},
+		{"9d7f3e", 0, 0},
+		{"", 0, 0},
+	}
+	for _, tt := range tests {
+		v, n := quicVarint(unhex(tt.in))
+		if v != tt.want || n != tt.n {
+			t.Errorf("quicVarint(%s) = %d, %d; want %d, %d", tt.in, v, n, tt.want, tt.n)
+		}
+	}
+}
+
+// quicClientHello returns the ClientHello crypto/tls sends in the Initial
+// packets of a QUIC connection to serverName.
+func quicClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	conn := tls.QUICClient(&tls.QUICConfig{TLSConfig: &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: serverName == "",
+		MinVersion:         tls.VersionTLS13,
+		NextProtos:         []string{"h3"},
+	}})
+	defer conn.Close()
+	conn.SetTransportParameters(nil)
+	if err := conn.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var hello []byte
+	for ev := conn.NextEvent(); ev.Kind != tls.QUICNoEvent; ev = conn.NextEvent() {
+		if ev.Kind == tls.QUICWriteData && ev.Level == tls.QUICEncryptionLevelInitial {
+			hello = append(hello, ev.Data...)
+		}
+	}
+	return hello
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	if v < 1<<14 {
+		return binary.BigEndian.AppendUint16(b, uint16(v)|0x4000)
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(v)|0x80000000)
+}
+
+// cryptoFrame returns a CRYPTO frame carrying data at offset.
+func cryptoFrame(offset int, data []byte) []byte {
+	b := appendVarint([]byte{0x06}, uint64(offset))
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// sealInitial builds a client Initial packet of 1200 bytes carrying frames,
+// protected with the RFC keys of version as in RFC 9001 section 5.
+func sealInitial(t *testing.T, version int, frames ...[]byte) []byte {
+	t.Helper()
+	keys := quicKeys[version]
+	const pnLen = 4
+	first := byte(0xc0 | (pnLen - 1))
+	if keys.version == quicVersion2 {
+		first |= 1 << 4 // Initial is type 1 in QUIC v2
+	}
+	header := binary.BigEndian.AppendUint32([]byte{first}, keys.version)
+	header = append(header, byte(len(testDCID)))
+	header = append(header, testDCID...)
+	header = append(header, 0, 0) // no SCID, no token
+
+	var payload []byte
+	for _, f := range frames {
+		payload = append(payload, f...)
+	}
+	block, _ := aes.NewCipher(unhex(keys.key))
+	aead, _ := cipher.NewGCM(block)
+	// PADDING up to 1200 bytes: header, 2 byte length, packet number, tag
+	payload = append(payload, make([]byte, 1200-len(header)-2-pnLen-aead.Overhead()-len(payload))...)
+
+	header = appendVarint(header, uint64(pnLen+len(payload)+aead.Overhead()))
+	pnOffset := len(header)
+	header = binary.BigEndian.AppendUint32(header, 2)
+	nonce := unhex(keys.iv)
+	nonce[len(nonce)-1] ^= 2
+	sealed := aead.Seal(nil, nonce, payload, header)
+
+	hp, _ := aes.NewCipher(unhex(keys.hp))
+	mask := make([]byte, 16)
+	hp.Encrypt(mask, sealed[:16])
+	header[0] ^= mask[0] & 0x0f
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+	}
+	return append(header, sealed...)
+}
+
+func TestQUICServerName(t *testing.T) {
+	hello := quicClientHello(t, "www.example.com")
+	for version := range quicKeys {
+		t.Run(quicKeys[version].name, func(t *testing.T) {
+			ping := []byte{0x01}
+			tests := []struct {
+				name     string
+				datagram []byte
+				want     string
+				wantErr  error
+			}{
+				{"single packet", sealInitial(t, version, ping, cryptoFrame(0, hello)), "www.example.com", nil},
+				{"coalesced 0-RTT", append(sealInitial(t, version, cryptoFrame(0, hello)), 0xd0, 0, 0, 0, 1, 0, 0), "www.example.com", nil},
+				{"first fragment", sealInitial(t, version, cryptoFrame(0, hello[:100])), "", ErrIncomplete},
+				{"no server name", sealInitial(t, version, cryptoFrame(0, quicClientHello(t, ""))), "", ErrNoName},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					got, err := QUICServerName(tt.datagram)
+					if got != tt.want || err != tt.wantErr {
+						t.Errorf("QUICServerName = %q, %v; want %q, %v", got, err, tt.want, tt.wantErr)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestQUICSnifferReassembly(t *testing.T) {
+	hello := quicClientHello(t, "www.example.com")
+	var s QUICSniffer
+	// The second half arrives first and the halves overlap.
+	if _, err := s.Feed(sealInitial(t, 0, cryptoFrame(100, hello[100:]))); err != ErrIncomplete {
+		t.Fatalf("second half: got %v, want ErrIncomplete", err)
+	}
+	got, err := s.Feed(sealInitial(t, 0, cryptoFrame(0, hello[:120])))
+	if got != "www.example.com" || err != nil {
+		t.Errorf("Feed = %q, %v; want www.example.com", got, err)
+	}
+}
+
+func TestQUICNotMatch(t *testing.T) {
+	hello := quicClientHello(t, "www.example.com")
+	packet := sealInitial(t, 0, cryptoFrame(0, hello))
+
+	tampered := append([]byte(nil), packet...)
+	tampered[100] ^= 1
+	otherVersion := append([]byte(nil), packet...)
+	binary.BigEndian.PutUint32(otherVersion[1:], 0xff00001d)
+	// A v1 Initial read as v2 has the type of a 0-RTT packet.
+	wrongType := append([]byte(nil), packet...)
+	binary.BigEndian.PutUint32(wrongType[1:], quicVersion2)
+
+	tests := []struct {
+		name     string
+		datagram []byte
+		wantErr  error
+	}{
+		{"tampered", tampered, ErrNotMatch},
+		{"unknown version", otherVersion, ErrNotMatch},
+		{"wrong type", wrongType, ErrNotMatch},
+		{"short header", append([]byte{0x40}, packet[1:]...), ErrNotMatch},
+		{"dns", unhex("abcd01000001000000000000076578616d706c6503636f6d0000010001"), ErrNotMatch},
+		{"truncated", packet[:40], errQUICMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := QUICServerName(tt.datagram); err != tt.wantErr {
+				t.Errorf("QUICServerName = %q, %v; want %v", got, err, tt.wantErr)
+			}
+		})
+	}
+}
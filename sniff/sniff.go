@@ -0,0 +1,38 @@
+// Package sniff recovers the destination hostname from the first bytes a
+// client sends: the SNI of a TLS ClientHello, the Host header of an
+// HTTP/1.x request, or the SNI inside QUIC Initial packets.
+package sniff
+
+import "errors"
+
+var (
+	// ErrIncomplete means the data looks like a known protocol but more
+	// bytes are needed to find the name.
+	ErrIncomplete = errors.New("sniff: incomplete data")
+	// ErrNotMatch means the data is not a protocol this package knows.
+	ErrNotMatch = errors.New("sniff: protocol not recognized")
+	// ErrNoName means the protocol was recognized but carries no name.
+	ErrNoName = errors.New("sniff: no server name")
+)
+
+// Domain tries every sniffer on b. It returns ErrIncomplete if any of them
+// needs more data and ErrNotMatch if none recognizes b.
+func Domain(b []byte) (string, error) {
+	incomplete := false
+	for _, sniffer := range []func([]byte) (string, error){TLSServerName, HTTPHost} {
+		name, err := sniffer(b)
+		switch err {
+		case nil:
+			return name, nil
+		case ErrIncomplete:
+			incomplete = true
+		case ErrNotMatch:
+		default:
+			return "", err
+		}
+	}
+	if incomplete {
+		return "", ErrIncomplete
+	}
+	return "", ErrNotMatch
+}
@@ -0,0 +1,119 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// clientHello returns the first TLS record crypto/tls sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(server, head); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[3:]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(head, body...)
+}
+
+// splitRecord carries the handshake message of record in two records.
+func splitRecord(record []byte, at int) []byte {
+	msg := record[5:]
+	first := append([]byte{0x16, 0x03, 0x01}, binary.BigEndian.AppendUint16(nil, uint16(at))...)
+	first = append(first, msg[:at]...)
+	second := append([]byte{0x16, 0x03, 0x01}, binary.BigEndian.AppendUint16(nil, uint16(len(msg)-at))...)
+	return append(append(first, second...), msg[at:]...)
+}
+
+func TestTLSServerName(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	noSNI := clientHello(t, "")
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr error
+	}{
+		{"client hello", hello, "www.example.com", nil},
+		{"two records", splitRecord(hello, 40), "www.example.com", nil},
+		{"truncated record", hello[:len(hello)-10], "", ErrIncomplete},
+		{"first of two records", splitRecord(hello, 40)[:50], "", ErrIncomplete},
+		{"record header only", hello[:3], "", ErrIncomplete},
+		{"no server name", noSNI, "", ErrNoName},
+		{"application data", []byte{0x17, 0x03, 0x03, 0x00, 0x01, 0x00}, "", ErrNotMatch},
+		{"server hello", []byte{0x16, 0x03, 0x03, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00}, "", ErrNotMatch},
+		{"http", []byte("GET / HTTP/1.1\r\n"), "", ErrNotMatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := TLSServerName(tt.data)
+			if got != tt.want || err != tt.wantErr {
+				t.Errorf("TLSServerName = %q, %v; want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr error
+	}{
+		{"get", "GET / HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n\r\n", "example.com", nil},
+		{"port", "POST /api HTTP/1.1\r\nhost: api.example.com:8080\r\n\r\nbody", "api.example.com", nil},
+		{"http/1.0", "HEAD / HTTP/1.0\r\nUser-Agent: x\r\nHOST:  example.org \r\n\r\n", "example.org", nil},
+		{"ipv4 literal", "GET / HTTP/1.1\r\nHost: 192.0.2.1:80\r\n\r\n", "", ErrNoName},
+		{"ipv6 literal", "GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", "", ErrNoName},
+		{"no host", "GET / HTTP/1.0\r\n\r\n", "", ErrNoName},
+		{"headers incomplete", "GET / HTTP/1.1\r\nHost: example.com\r\n", "", ErrIncomplete},
+		{"partial method", "GE", "", ErrIncomplete},
+		{"http/2 preface", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", "", ErrNotMatch},
+		{"not http/1", "GET / FOO\r\nHost: example.com\r\n\r\n", "", ErrNotMatch},
+		{"ssh", "SSH-2.0-OpenSSH_9.6\r\n", "", ErrNotMatch},
+		{"empty", "", "", ErrNotMatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := HTTPHost([]byte(tt.data))
+			if got != tt.want || err != tt.wantErr {
+				t.Errorf("HTTPHost = %q, %v; want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDomain(t *testing.T) {
+	hello := clientHello(t, "example.net")
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr error
+	}{
+		{"tls", hello, "example.net", nil},
+		{"http", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "example.com", nil},
+		{"incomplete tls", hello[:20], "", ErrIncomplete},
+		{"incomplete http", []byte("GET / HTTP/1.1\r\n"), "", ErrIncomplete},
+		{"neither", []byte("SSH-2.0-OpenSSH_9.6\r\n"), "", ErrNotMatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Domain(tt.data)
+			if got != tt.want || err != tt.wantErr {
+				t.Errorf("Domain = %q, %v; want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
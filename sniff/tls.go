@@ -0,0 +1,144 @@
+package sniff
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errMalformed = errors.New("sniff: malformed TLS ClientHello")
+
+// TLSServerName extracts the SNI from a TLS ClientHello, which may span
+// several handshake records.
+func TLSServerName(b []byte) (string, error) {
+	var msg []byte
+	for len(b) > 0 {
+		if len(b) < 5 {
+			return "", ErrIncomplete
+		}
+		// ContentType handshake, legacy version 3.x
+		if b[0] != 0x16 || b[1] != 0x03 {
+			return "", ErrNotMatch
+		}
+		n := int(binary.BigEndian.Uint16(b[3:5]))
+		if len(b) < 5+n {
+			msg = append(msg, b[5:]...)
+			break
+		}
+		msg = append(msg, b[5:5+n]...)
+		b = b[5+n:]
+		if len(msg) >= 4 && len(msg) >= 4+handshakeLen(msg) {
+			break
+		}
+	}
+	if len(msg) < 4 {
+		return "", ErrIncomplete
+	}
+	if msg[0] != 0x01 {
+		return "", ErrNotMatch
+	}
+	if len(msg) < 4+handshakeLen(msg) {
+		return "", ErrIncomplete
+	}
+	return ClientHelloServerName(msg)
+}
+
+func handshakeLen(msg []byte) int {
+	return int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+}
+
+// ClientHelloServerName extracts the SNI from a ClientHello handshake
+// message, without the record layer, as carried in QUIC CRYPTO frames.
+func ClientHelloServerName(msg []byte) (string, error) {
+	if len(msg) < 4 || msg[0] != 0x01 {
+		return "", ErrNotMatch
+	}
+	n := handshakeLen(msg)
+	if len(msg) < 4+n {
+		return "", ErrIncomplete
+	}
+	r := reader(msg[4 : 4+n])
+
+	// legacy_version, random
+	if !r.skip(2 + 32) {
+		return "", errMalformed
+	}
+	// legacy_session_id, cipher_suites, legacy_compression_methods
+	if !r.skipVector(1) || !r.skipVector(2) || !r.skipVector(1) {
+		return "", errMalformed
+	}
+	if len(r) == 0 {
+		return "", ErrNoName
+	}
+	exts, ok := r.vector(2)
+	if !ok {
+		return "", errMalformed
+	}
+	for len(exts) > 0 {
+		typ, ok1 := exts.uint16()
+		data, ok2 := exts.vector(2)
+		if !ok1 || !ok2 {
+			return "", errMalformed
+		}
+		if typ != 0x0000 { // server_name
+			continue
+		}
+		list, ok := data.vector(2)
+		if !ok {
+			return "", errMalformed
+		}
+		for len(list) > 0 {
+			nameType := list[0]
+			list = list[1:]
+			name, ok := list.vector(2)
+			if !ok {
+				return "", errMalformed
+			}
+			if nameType == 0 && len(name) > 0 { // host_name
+				return string(name), nil
+			}
+		}
+	}
+	return "", ErrNoName
+}
+
+// reader consumes big-endian fields from a byte slice.
+type reader []byte
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+// vector reads a field prefixed by a lenBytes-long length.
+func (r *reader) vector(lenBytes int) (reader, bool) {
+	if len(*r) < lenBytes {
+		return nil, false
+	}
+	n := 0
+	for _, c := range (*r)[:lenBytes] {
+		n = n<<8 | int(c)
+	}
+	if len(*r) < lenBytes+n {
+		return nil, false
+	}
+	v := (*r)[lenBytes : lenBytes+n]
+	*r = (*r)[lenBytes+n:]
+	return v, true
+}
+
+func (r *reader) skipVector(lenBytes int) bool {
+	_, ok := r.vector(lenBytes)
+	return ok
+}
@@ -0,0 +1,151 @@
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 地址类型 ATYP
+const (
+	SOCKS5_ATYP_IPV4   = 0x01
+	SOCKS5_ATYP_DOMAIN = 0x03
+	SOCKS5_ATYP_IPV6   = 0x04
+)
+
+var errShortAddr = errors.New("socks5: short address")
+
+// Addr 表示 SOCKS5 协议中的地址字段 ATYP + ADDR + PORT
+// IP 不为空时按 IPv4/IPv6 编码，否则按域名编码
+type Addr struct {
+	IP   net.IP
+	Name string
+	Port uint16
+}
+
+// ParseAddr 解析 "host:port" 格式的地址，host 可以是 IPv4、IPv6 或域名
+func ParseAddr(hostport string) (*Addr, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port %q", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &Addr{IP: ip, Port: uint16(port)}, nil
+	}
+	if len(host) == 0 || len(host) > 255 {
+		return nil, fmt.Errorf("socks5: invalid domain %q", host)
+	}
+	return &Addr{Name: host, Port: uint16(port)}, nil
+}
+
+// Network 实现 net.Addr
+func (a *Addr) Network() string {
+	return "socks5"
+}
+
+// String 返回 "host:port" 格式的地址
+func (a *Addr) String() string {
+	host := a.Name
+	if a.IP != nil {
+		host = a.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(a.Port)))
+}
+
+// UDPAddr 在地址为 IP 时返回对应的 *net.UDPAddr，域名地址返回 nil
+func (a *Addr) UDPAddr() *net.UDPAddr {
+	if a.IP == nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: a.IP, Port: int(a.Port)}
+}
+
+// AppendTo 将地址按 ATYP + ADDR + PORT 编码追加到 b
+func (a *Addr) AppendTo(b []byte) []byte {
+	if ip4 := a.IP.To4(); ip4 != nil {
+		b = append(b, SOCKS5_ATYP_IPV4)
+		b = append(b, ip4...)
+	} else if a.IP != nil {
+		b = append(b, SOCKS5_ATYP_IPV6)
+		b = append(b, a.IP.To16()...)
+	} else {
+		b = append(b, SOCKS5_ATYP_DOMAIN, byte(len(a.Name)))
+		b = append(b, a.Name...)
+	}
+	return binary.BigEndian.AppendUint16(b, a.Port)
+}
+
+// ReadAddr 从 r 中读取一个 ATYP + ADDR + PORT 编码的地址
+func ReadAddr(r io.Reader) (*Addr, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return nil, err
+	}
+	a := &Addr{}
+	switch atyp[0] {
+	case SOCKS5_ATYP_IPV4:
+		a.IP = make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(r, a.IP); err != nil {
+			return nil, err
+		}
+	case SOCKS5_ATYP_IPV6:
+		a.IP = make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(r, a.IP); err != nil {
+			return nil, err
+		}
+	case SOCKS5_ATYP_DOMAIN:
+		if _, err := io.ReadFull(r, atyp); err != nil {
+			return nil, err
+		}
+		name := make([]byte, atyp[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		a.Name = string(name)
+	default:
+		return nil, fmt.Errorf("socks5: unsupported address type 0x%02x", atyp[0])
+	}
+	if err := binary.Read(r, binary.BigEndian, &a.Port); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SplitAddr 从 b 的开头解析地址，返回地址和其占用的字节数
+func SplitAddr(b []byte) (*Addr, int, error) {
+	if len(b) < 1 {
+		return nil, 0, errShortAddr
+	}
+	a := &Addr{}
+	var n int
+	switch b[0] {
+	case SOCKS5_ATYP_IPV4:
+		n = 1 + net.IPv4len
+	case SOCKS5_ATYP_IPV6:
+		n = 1 + net.IPv6len
+	case SOCKS5_ATYP_DOMAIN:
+		if len(b) < 2 {
+			return nil, 0, errShortAddr
+		}
+		n = 2 + int(b[1])
+	default:
+		return nil, 0, fmt.Errorf("socks5: unsupported address type 0x%02x", b[0])
+	}
+	if len(b) < n+2 {
+		return nil, 0, errShortAddr
+	}
+	if b[0] == SOCKS5_ATYP_DOMAIN {
+		a.Name = string(b[2:n])
+	} else {
+		a.IP = append(net.IP(nil), b[1:n]...)
+	}
+	a.Port = binary.BigEndian.Uint16(b[n:])
+	return a, n + 2, nil
+}
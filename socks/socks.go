@@ -1,21 +1,54 @@
 package socks
 
 import (
-	"bytes"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/url"
-	"strconv"
-	"strings"
+	"syscall"
 )
 
 var SOCKS5_CONNECT_CMD = 0x01
 var SOCKS5_BIND_CMD = 0x02
 var SOCKS5_UDP_ASSOCIATE_CMD = 0x03
 
+// Control 在 NewConn 和 UDP 中继连接的 socket 创建后、连接前调用
+// 可以设置 SO_MARK、绑定网卡等，避免到代理的连接又被路由回 TUN
+var Control func(network, address string, c syscall.RawConn) error
+
+// SOCKS5 应答 REP 字段对应的错误，可以使用 errors.Is 判断
+var (
+	ErrGeneralFailure       = errors.New("socks5: general SOCKS server failure")
+	ErrConnectionNotAllowed = errors.New("socks5: connection not allowed by ruleset")
+	ErrNetworkUnreachable   = errors.New("socks5: network unreachable")
+	ErrHostUnreachable      = errors.New("socks5: host unreachable")
+	ErrConnectionRefused    = errors.New("socks5: connection refused")
+	ErrTTLExpired           = errors.New("socks5: TTL expired")
+	ErrCommandNotSupported  = errors.New("socks5: command not supported")
+	ErrAddressNotSupported  = errors.New("socks5: address type not supported")
+)
+
+var replyErrors = []error{
+	0x01: ErrGeneralFailure,
+	0x02: ErrConnectionNotAllowed,
+	0x03: ErrNetworkUnreachable,
+	0x04: ErrHostUnreachable,
+	0x05: ErrConnectionRefused,
+	0x06: ErrTTLExpired,
+	0x07: ErrCommandNotSupported,
+	0x08: ErrAddressNotSupported,
+}
+
+// replyError 将 REP 字段转换为错误
+func replyError(rep byte) error {
+	if int(rep) < len(replyErrors) && replyErrors[rep] != nil {
+		return replyErrors[rep]
+	}
+	return fmt.Errorf("socks5: unknown reply 0x%02x", rep)
+}
+
 func NewConn(sock5Addr string) (net.Conn, error) {
 	parsedURL, err := url.Parse(sock5Addr)
 	if err != nil {
@@ -31,35 +64,55 @@ func NewConn(sock5Addr string) (net.Conn, error) {
 	}
 
 	// 建立到SOCKS5代理服务器的连接
-	socksConn, err := net.Dial("tcp", host+":"+port)
+	dialer := net.Dialer{Control: Control}
+	socksConn, err := dialer.Dial("tcp", host+":"+port)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
 
+	if err := Handshake(socksConn, parsedURL.User); err != nil {
+		socksConn.Close()
+		return nil, err
+	}
+
+	// 认证成功，返回已建立的连接
+	return socksConn, nil
+}
+
+// Handshake 在已建立的连接上完成 SOCKS5 方法协商和用户名/密码认证
+// user 为空时只提供无认证方法
+func Handshake(socksConn net.Conn, user *url.Userinfo) error {
+	// 从URL中提取用户名和密码
+	username := user.Username()
+	password, _ := user.Password()
+
 	// 发送SOCKS5握手请求
 	// 0x05: SOCKS5版本
-	// 0x01: 支持的认证方法数量
+	// 0x01/0x02: 支持的认证方法数量
 	// 0x00: 不需要认证方法
-	socksConn.Write([]byte{0x05, 0x01, 0x00})
+	// 0x02: 用户名/密码认证方法
+	greeting := []byte{0x05, 0x01, 0x00}
+	if username != "" {
+		greeting = []byte{0x05, 0x02, 0x00, 0x02}
+	}
+	if _, err := socksConn.Write(greeting); err != nil {
+		return err
+	}
 
 	// 读取服务器的认证响应
 	authBack := make([]byte, 2)
-	_, err = io.ReadFull(socksConn, authBack)
+	_, err := io.ReadFull(socksConn, authBack)
 	if err != nil {
 		log.Println(err)
-		return nil, err
+		return err
 	}
 
-	// 从URL中提取用户名和密码
-	username := parsedURL.User.Username()
-	password, _ := parsedURL.User.Password()
-
 	// 检查服务器选择的认证方法
 	if authBack[1] == 0x02 {
 		// 服务器要求用户名/密码认证
 		if username == "" || password == "" {
-			return nil, fmt.Errorf("socks5 username and password is empty")
+			return fmt.Errorf("socks5 username and password is empty")
 		}
 
 		// 构造用户名/密码认证请求
@@ -70,66 +123,74 @@ func NewConn(sock5Addr string) (net.Conn, error) {
 		auth = append(auth, []byte(password)...)
 
 		// 发送认证请求
-		socksConn.Write(auth)
+		if _, err := socksConn.Write(auth); err != nil {
+			return err
+		}
 
 		// 读取认证响应
 		authResponse := make([]byte, 2)
 		_, err = io.ReadFull(socksConn, authResponse)
 		if err != nil {
 			log.Println(err)
-			return nil, err
+			return err
 		}
 
 		// 检查认证是否成功
 		if authResponse[1] != 0x00 {
-			return nil, fmt.Errorf("authentication failed")
+			return fmt.Errorf("authentication failed")
 		}
 	} else if authBack[1] != 0x00 {
 		// 服务器不接受无认证方法，也不接受用户名/密码认证
-		return nil, fmt.Errorf("no acceptable authentication methods")
+		return fmt.Errorf("no acceptable authentication methods")
 	}
-
-	// 认证成功，返回已建立的连接
-	return socksConn, nil
+	return nil
 }
 
 /*to socks5*/
 // SocksCmd 发送SOCKS5命令到代理服务器
 // socksConn: 与SOCKS5服务器建立的连接
 // cmd: SOCKS5命令（例如：0x01表示CONNECT）
-// host: 目标主机地址，格式为"IP:端口"
+// host: 目标主机地址，格式为"host:端口"，host 可以是 IPv4、IPv6 或域名
 func SocksCmd(socksConn net.Conn, cmd uint8, host string) error {
-	// 解析目标主机地址
-	hosts := strings.Split(host, ":")
-	rAddr := net.ParseIP(hosts[0])
-	_port, _ := strconv.Atoi(hosts[1])
-
-	// 构造SOCKS5请求头
-	// 0x05: SOCKS版本号
-	// cmd: 命令（如CONNECT）
-	// 0x00: 保留字段
-	// 0x01: IPv4地址类型
-	msg := []byte{0x05, cmd, 0x00, 0x01}
-	buffer := bytes.NewBuffer(msg)
-
-	// 写入目标IP地址（4字节）
-	binary.Write(buffer, binary.BigEndian, rAddr.To4())
-
-	// 写入目标端口（2字节）
-	binary.Write(buffer, binary.BigEndian, uint16(_port))
-
-	// 发送SOCKS5请求到服务器
-	socksConn.Write(buffer.Bytes())
-
-	// 读取服务器响应
-	conectBack := make([]byte, 10)
-	_, err := io.ReadFull(socksConn, conectBack)
+	dst, err := ParseAddr(host)
 	if err != nil {
-		log.Println("读取SOCKS5服务器响应失败:", err)
 		return err
 	}
+	_, err = Request(socksConn, cmd, dst)
+	return err
+}
 
-	// TODO: 解析服务器响应，检查是否成功建立连接
+// Request 发送 SOCKS5 请求并读取应答，成功时返回应答中的 BND.ADDR:BND.PORT
+// +----+-----+-------+------+----------+----------+
+// |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+// +----+-----+-------+------+----------+----------+
+// | 1  |  1  | X'00' |  1   | Variable |    2     |
+// +----+-----+-------+------+----------+----------+
+func Request(socksConn net.Conn, cmd uint8, dst *Addr) (*Addr, error) {
+	msg := dst.AppendTo([]byte{0x05, cmd, 0x00})
+	if _, err := socksConn.Write(msg); err != nil {
+		return nil, err
+	}
+	return ReadReply(socksConn)
+}
 
-	return nil
+// ReadReply 读取 SOCKS5 应答，REP 不为成功时返回对应的错误
+// +----+-----+-------+------+----------+----------+
+// |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+// +----+-----+-------+------+----------+----------+
+// | 1  |  1  | X'00' |  1   | Variable |    2     |
+// +----+-----+-------+------+----------+----------+
+func ReadReply(r io.Reader) (*Addr, error) {
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(r, head); err != nil {
+		log.Println("读取SOCKS5服务器响应失败:", err)
+		return nil, err
+	}
+	if head[0] != 0x05 {
+		return nil, fmt.Errorf("socks5: unexpected reply version 0x%02x", head[0])
+	}
+	if head[1] != 0x00 {
+		return nil, replyError(head[1])
+	}
+	return ReadAddr(r)
 }
@@ -0,0 +1,64 @@
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// SOCKS4 应答 CD 字段对应的错误，0x5A 表示请求成功
+var (
+	ErrSocks4Rejected       = errors.New("socks4: request rejected or failed")
+	ErrSocks4NoIdentd       = errors.New("socks4: request rejected, server cannot connect to identd on the client")
+	ErrSocks4IdentdMismatch = errors.New("socks4: request rejected, client and identd report different user-ids")
+	ErrSocks4IPv6           = errors.New("socks4: IPv6 destinations are not supported")
+)
+
+// Socks4Connect 在已建立的连接上发送 SOCKS4 CONNECT 请求
+// socks4a 为 true 时域名地址交给服务器解析，否则 dst 必须是 IPv4 地址
+// +----+----+----+----+----+----+----+----+----+----+....+----+
+// | VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+// +----+----+----+----+----+----+----+----+----+----+....+----+
+// | 1  | 1  |    2    |         4         | variable     | 1  |
+// +----+----+----+----+----+----+----+----+----+----+....+----+
+func Socks4Connect(socksConn net.Conn, dst *Addr, userID string, socks4a bool) error {
+	msg := binary.BigEndian.AppendUint16([]byte{0x04, 0x01}, dst.Port)
+	switch {
+	case dst.IP != nil && dst.IP.To4() == nil:
+		return ErrSocks4IPv6
+	case dst.IP != nil:
+		msg = append(msg, dst.IP.To4()...)
+	case socks4a:
+		// SOCKS4a: DSTIP 为 0.0.0.x（x 非 0），域名跟在 USERID 之后
+		msg = append(msg, 0, 0, 0, 1)
+	default:
+		return fmt.Errorf("socks4: cannot send domain %s without socks4a", dst.Name)
+	}
+	msg = append(append(msg, userID...), 0x00)
+	if dst.IP == nil {
+		msg = append(append(msg, dst.Name...), 0x00)
+	}
+	if _, err := socksConn.Write(msg); err != nil {
+		return err
+	}
+
+	// 应答：VN(0) CD DSTPORT DSTIP，共 8 字节
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(socksConn, reply); err != nil {
+		return err
+	}
+	switch reply[1] {
+	case 0x5A:
+		return nil
+	case 0x5B:
+		return ErrSocks4Rejected
+	case 0x5C:
+		return ErrSocks4NoIdentd
+	case 0x5D:
+		return ErrSocks4IdentdMismatch
+	default:
+		return fmt.Errorf("socks4: unknown reply 0x%02x", reply[1])
+	}
+}
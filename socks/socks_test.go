@@ -0,0 +1,145 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestAddrCodec(t *testing.T) {
+	tests := []struct {
+		hostport string
+		wire     []byte
+	}{
+		{"192.0.2.1:80", []byte{0x01, 192, 0, 2, 1, 0x00, 0x50}},
+		{"[2001:db8::1]:443", []byte{0x04, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 0xbb}},
+		{"example.com:53", append(append([]byte{0x03, 11}, "example.com"...), 0x00, 0x35)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hostport, func(t *testing.T) {
+			a, err := ParseAddr(tt.hostport)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := a.AppendTo(nil); !bytes.Equal(got, tt.wire) {
+				t.Errorf("AppendTo = %x, want %x", got, tt.wire)
+			}
+
+			read, err := ReadAddr(bytes.NewReader(tt.wire))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if read.String() != tt.hostport {
+				t.Errorf("ReadAddr = %s, want %s", read, tt.hostport)
+			}
+
+			// 后面跟着的数据不属于地址
+			split, n, err := SplitAddr(append(tt.wire, "payload"...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(tt.wire) || split.String() != tt.hostport {
+				t.Errorf("SplitAddr = %s, %d; want %s, %d", split, n, tt.hostport, len(tt.wire))
+			}
+		})
+	}
+}
+
+func TestParseAddrInvalid(t *testing.T) {
+	for _, hostport := range []string{"example.com", "example.com:65536", "example.com:http", ":80"} {
+		if a, err := ParseAddr(hostport); err == nil {
+			t.Errorf("ParseAddr(%q) = %s, want error", hostport, a)
+		}
+	}
+}
+
+func TestSplitAddrInvalid(t *testing.T) {
+	tests := [][]byte{
+		{},
+		{0x01, 192, 0, 2, 1, 0x00},
+		{0x03},
+		{0x03, 11, 'e', 'x'},
+		{0x04, 0x20, 0x01},
+		{0x02, 0, 0, 0, 0, 0, 0},
+	}
+	for _, b := range tests {
+		if a, _, err := SplitAddr(b); err == nil {
+			t.Errorf("SplitAddr(%x) = %s, want error", b, a)
+		}
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	bnd := []byte{0x01, 10, 0, 0, 1, 0x04, 0x38}
+	tests := []struct {
+		head []byte
+		want error
+	}{
+		{[]byte{0x05, 0x01, 0x00}, ErrGeneralFailure},
+		{[]byte{0x05, 0x02, 0x00}, ErrConnectionNotAllowed},
+		{[]byte{0x05, 0x03, 0x00}, ErrNetworkUnreachable},
+		{[]byte{0x05, 0x04, 0x00}, ErrHostUnreachable},
+		{[]byte{0x05, 0x05, 0x00}, ErrConnectionRefused},
+		{[]byte{0x05, 0x06, 0x00}, ErrTTLExpired},
+		{[]byte{0x05, 0x07, 0x00}, ErrCommandNotSupported},
+		{[]byte{0x05, 0x08, 0x00}, ErrAddressNotSupported},
+	}
+	for _, tt := range tests {
+		_, err := ReadReply(bytes.NewReader(append(tt.head, bnd...)))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("REP 0x%02x: got %v, want %v", tt.head[1], err, tt.want)
+		}
+	}
+
+	// 未定义的 REP 和错误的版本号
+	for _, head := range [][]byte{{0x05, 0x09, 0x00}, {0x04, 0x00, 0x00}} {
+		if _, err := ReadReply(bytes.NewReader(append(head, bnd...))); err == nil {
+			t.Errorf("reply %x: want error", head)
+		}
+	}
+	if _, err := ReadReply(bytes.NewReader([]byte{0x05})); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("short reply: got %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	a, err := ReadReply(bytes.NewReader(append([]byte{0x05, 0x00, 0x00}, bnd...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.String() != "10.0.0.1:1080" {
+		t.Errorf("BND = %s, want 10.0.0.1:1080", a)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		req := make([]byte, 3+2+11+2)
+		if _, err := io.ReadFull(server, req); err != nil {
+			return
+		}
+		server.Write(append(req[:0:0], 0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0))
+		server.Write(req)
+	}()
+
+	dst, _ := ParseAddr("example.com:443")
+	bnd, err := Request(client, 0x01, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bnd.String() != "0.0.0.0:0" {
+		t.Errorf("BND = %s, want 0.0.0.0:0", bnd)
+	}
+	// 服务器把收到的请求原样发回，检查请求的编码
+	echo := make([]byte, 18)
+	if _, err := io.ReadFull(client, echo); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{0x05, 0x01, 0x00}, dst.AppendTo(nil)...)
+	if !bytes.Equal(echo, want) {
+		t.Errorf("request = %x, want %x", echo, want)
+	}
+}
@@ -0,0 +1,145 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// UDPConn 是通过 SOCKS5 UDP ASSOCIATE 建立的 UDP 中继连接
+// 控制用的 TCP 连接必须在整个会话期间保持打开，关闭后代理会释放中继端口
+type UDPConn struct {
+	ctrl  net.Conn     // UDP ASSOCIATE 控制连接
+	relay *net.UDPConn // 到代理中继地址的 UDP 连接
+}
+
+var _ net.PacketConn = (*UDPConn)(nil)
+
+// NewUDPConn 连接 SOCKS5 代理并发送 UDP ASSOCIATE 命令，返回可收发数据报的中继连接
+func NewUDPConn(sock5Addr string) (*UDPConn, error) {
+	ctrl, err := NewConn(sock5Addr)
+	if err != nil {
+		return nil, err
+	}
+	// NewConn 已经解析过地址
+	u, _ := url.Parse(sock5Addr)
+	return Associate(context.Background(), ctrl, u.Hostname())
+}
+
+// Associate 在已完成握手的控制连接上发送 UDP ASSOCIATE 命令
+// server 是代理服务器的主机名或 IP，代理返回 0.0.0.0 且 ctrl 不是直接的 TCP 连接时
+// （例如经过代理链、TLS 或 Shadowsocks 包装）用它作为中继地址
+// 返回的 UDPConn 接管 ctrl，关闭时一并关闭
+func Associate(ctx context.Context, ctrl net.Conn, server string) (*UDPConn, error) {
+	// DST.ADDR 填 0.0.0.0:0，表示客户端发送数据报的地址事先未知
+	bnd, err := Request(ctrl, uint8(SOCKS5_UDP_ASSOCIATE_CMD), &Addr{IP: net.IPv4zero})
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	host := bnd.Name
+	if bnd.IP != nil {
+		host = bnd.IP.String()
+	}
+
+	// 代理返回 0.0.0.0 时，中继地址与代理服务器地址相同
+	if bnd.IP != nil && bnd.IP.IsUnspecified() {
+		if tcpAddr, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			host = tcpAddr.IP.String()
+		} else {
+			host = server
+		}
+	}
+	dialer := net.Dialer{Control: Control}
+	relay, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(host, strconv.Itoa(int(bnd.Port))))
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("socks5 udp associate: relay %s: %w", host, err)
+	}
+
+	c := &UDPConn{ctrl: ctrl, relay: relay.(*net.UDPConn)}
+	go c.watchCtrl()
+	return c, nil
+}
+
+// watchCtrl 在控制连接断开时关闭中继连接
+func (c *UDPConn) watchCtrl() {
+	io.Copy(io.Discard, c.ctrl)
+	c.relay.Close()
+}
+
+// WriteTo 添加 SOCKS5 UDP 请求头后发送到中继地址
+// +----+------+------+----------+----------+----------+
+// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+// +----+------+------+----------+----------+----------+
+// | 2  |  1   |  1   | Variable |    2     | Variable |
+// +----+------+------+----------+----------+----------+
+func (c *UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst, ok := addr.(*Addr)
+	if !ok {
+		var err error
+		if dst, err = ParseAddr(addr.String()); err != nil {
+			return 0, err
+		}
+	}
+	msg := make([]byte, 0, len(b)+262)
+	msg = dst.AppendTo(append(msg, 0x00, 0x00, 0x00))
+	msg = append(msg, b...)
+
+	if _, err := c.relay.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom 从中继地址读取数据报并去掉 SOCKS5 UDP 请求头，分片数据报直接丢弃
+// 来源为 IP 时返回 *net.UDPAddr，为域名时返回 *Addr
+func (c *UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, err := c.relay.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < 3 || buf[2] != 0x00 {
+			continue
+		}
+		src, l, err := SplitAddr(buf[3:n])
+		if err != nil {
+			continue
+		}
+		if udpAddr := src.UDPAddr(); udpAddr != nil {
+			return copy(b, buf[3+l:n]), udpAddr, nil
+		}
+		return copy(b, buf[3+l:n]), src, nil
+	}
+}
+
+func (c *UDPConn) Close() error {
+	err := c.ctrl.Close()
+	if rerr := c.relay.Close(); err == nil && !errors.Is(rerr, net.ErrClosed) {
+		err = rerr
+	}
+	return err
+}
+
+func (c *UDPConn) LocalAddr() net.Addr {
+	return c.relay.LocalAddr()
+}
+
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	return c.relay.SetDeadline(t)
+}
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	return c.relay.SetReadDeadline(t)
+}
+
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	return c.relay.SetWriteDeadline(t)
+}
@@ -0,0 +1,63 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAssociate(t *testing.T) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	port := relay.LocalAddr().(*net.UDPAddr).Port
+
+	// net.Pipe 的 RemoteAddr 不是 *net.TCPAddr，和包装过的控制连接一样
+	// 代理返回 0.0.0.0 时只能用 server 作为中继地址
+	client, server := net.Pipe()
+	go func() {
+		req := make([]byte, 3+7)
+		if _, err := io.ReadFull(server, req); err != nil {
+			return
+		}
+		server.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+		io.Copy(io.Discard, server)
+	}()
+
+	c, err := Associate(context.Background(), client, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	dst := &Addr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 53}
+	if _, err := c.WriteTo([]byte("query"), dst); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	relay.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := relay.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0, 0, 0, 0x01, 192, 0, 2, 1, 0, 53, 'q', 'u', 'e', 'r', 'y'}
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("relay got %x, want %x", buf[:n], want)
+	}
+
+	// 已取消的 ctx 让中继连接失败，并关闭控制连接
+	client2, server2 := net.Pipe()
+	go func() {
+		io.ReadFull(server2, make([]byte, 3+7))
+		server2.Write([]byte{0x05, 0x00, 0x00, 0x03, 9, 'r', 'e', 'l', 'a', 'y', '.', 'e', 'x', 'a', 0, 53})
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Associate(ctx, client2, "127.0.0.1"); err == nil {
+		t.Error("Associate with a canceled context succeeded")
+	}
+}
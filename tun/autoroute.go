@@ -0,0 +1,74 @@
+//go:build !windows && !wasm
+// +build !windows,!wasm
+
+package tun
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"runtime"
+)
+
+// 全局模式下经过 TUN 的路由，比默认路由更具体，不需要删除原来的默认路由
+var autoRoutes4 = []string{"0.0.0.0/1", "128.0.0.0/1"}
+var autoRoutes6 = []string{"::/1", "8000::/1"}
+
+// AutoRoute 全局模式：所有流量经过 TUN 设备，Bypass 中的地址（代理服务器等）
+// 仍然通过原来的网关访问，避免路由回环。目前只支持 Linux
+type AutoRoute struct {
+	Bypass []netip.Addr
+
+	// Interface 是安装前默认路由所在的网卡，可以用来绑定出口 socket
+	Interface string
+}
+
+// install 先添加绕过路由，再添加经过 TUN 的路由。table 不为 0 时（策略路由模式）
+// 两者都添加到该路由表。添加的路由记录在 changes 中
+func (r *AutoRoute) install(tunDevice string, table int, changes *Changes) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("auto route: unsupported on %s", runtime.GOOS)
+	}
+	def, err := DefaultRoute(false)
+	if err != nil {
+		return fmt.Errorf("auto route: %w", err)
+	}
+	r.Interface = def.Dev
+	log.Printf("auto route: default route %s", def)
+
+	for _, addr := range r.Bypass {
+		if err := r.bypass(addr, table, changes); err != nil {
+			return err
+		}
+	}
+	routes := autoRoutes4
+	// 没有 IPv6 默认路由时不接管 IPv6
+	if _, err := DefaultRoute(true); err == nil {
+		routes = append(routes[:len(routes):len(routes)], autoRoutes6...)
+	}
+	for _, cidr := range routes {
+		if err := changes.addRoute(Route{Dst: netip.MustParsePrefix(cidr), Dev: tunDevice, Table: table}); err != nil {
+			return fmt.Errorf("auto route: %w", err)
+		}
+	}
+	return nil
+}
+
+// bypass 为 addr 添加一条经过它当前网关的主机路由，同网段直连的地址不需要，
+// 当前不可达的地址跳过
+func (r *AutoRoute) bypass(addr netip.Addr, table int, changes *Changes) error {
+	route, err := RouteGet(addr)
+	if err != nil {
+		log.Printf("auto route: skip bypass: %v", err)
+		return nil
+	}
+	if !route.Gateway.IsValid() {
+		return nil
+	}
+	route.Dst = netip.PrefixFrom(addr, addr.BitLen())
+	route.Table = table
+	if err := changes.addRoute(route); err != nil {
+		return fmt.Errorf("auto route: %w", err)
+	}
+	return nil
+}
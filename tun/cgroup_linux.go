@@ -0,0 +1,168 @@
+//go:build linux
+
+package tun
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot 返回 cgroup v2 的挂载点，混合模式下通常是 /sys/fs/cgroup/unified
+func cgroupRoot() (string, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[2] == "cgroup2" {
+			return fields[1], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("cgroup v2 is not mounted")
+}
+
+// cgroupDir 返回 cgroup v2 路径对应的目录，path 相对于 cgroup v2 的根
+func cgroupDir(path string) (string, error) {
+	root, err := cgroupRoot()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, cleanCgroup(path)), nil
+}
+
+func cleanCgroup(path string) string {
+	return strings.Trim(filepath.Clean("/"+path), "/")
+}
+
+// createCgroup 创建 cgroup，已存在时直接使用
+func createCgroup(path string) error {
+	dir, err := cgroupDir(path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create cgroup %s: %w", path, err)
+	}
+	return nil
+}
+
+// JoinCgroup 把当前进程移入 cgroup，之后启动的子进程都在其中。cgroup 不存在时创建
+func JoinCgroup(path string) error {
+	if err := createCgroup(path); err != nil {
+		return err
+	}
+	dir, err := cgroupDir(path)
+	if err != nil {
+		return err
+	}
+	pid := strconv.Itoa(os.Getpid())
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(pid), 0); err != nil {
+		return fmt.Errorf("join cgroup %s: %w", path, err)
+	}
+	return nil
+}
+
+// markCgroup 添加给 cgroup 中进程发出的数据包打上 mark 的防火墙规则，优先使用
+// nftables，没有 nft 时使用 iptables 和 ip6tables。添加的规则记录在 changes 中
+func markCgroup(path string, mark int, changes *Changes) error {
+	path = cleanCgroup(path)
+	if _, err := exec.LookPath("nft"); err == nil {
+		return markCgroupNft(path, mark, changes)
+	}
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return errors.New("cgroup mark: neither nft nor iptables found")
+	}
+	for _, ipv6 := range []bool{false, true} {
+		if err := run(iptablesCmd(ipv6), cgroupMarkRule("-A", path, mark)...); err != nil {
+			if ipv6 {
+				// 没有 IPv6 时只标记 IPv4
+				continue
+			}
+			return err
+		}
+		if err := changes.record(Change{Kind: changeIptables, IPv6: ipv6, Cgroup: path, Mark: mark}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarkCgroupIptables 删除 markCgroup 通过 iptables 添加的规则
+func unmarkCgroupIptables(ipv6 bool, path string, mark int) error {
+	return run(iptablesCmd(ipv6), cgroupMarkRule("-D", cleanCgroup(path), mark)...)
+}
+
+// cgroupMarkRule 返回在 mangle 表 OUTPUT 链中添加（-A）或删除（-D）标记规则的参数
+func cgroupMarkRule(op string, path string, mark int) []string {
+	return []string{"-t", "mangle", op, "OUTPUT", "-m", "cgroup", "--path", path, "-j", "MARK", "--set-mark", strconv.Itoa(mark)}
+}
+
+// markCgroupNft 在 inet 表 tun2socks 中添加 route 类型的 output 链，标记后
+// 内核会按新的 mark 重新选路
+func markCgroupNft(path string, mark int, changes *Changes) error {
+	level := strconv.Itoa(strings.Count(path, "/") + 1)
+	cmds := [][]string{
+		{"add", "table", "inet", nftTable},
+		{"flush", "table", "inet", nftTable},
+		{"add", "chain", "inet", nftTable, "output", "{", "type", "route", "hook", "output", "priority", "mangle", ";", "}"},
+		{"add", "rule", "inet", nftTable, "output", "socket", "cgroupv2", "level", level, strconv.Quote(path), "meta", "mark", "set", strconv.Itoa(mark)},
+	}
+	for i, args := range cmds {
+		if err := run("nft", args...); err != nil {
+			if i > 0 {
+				unmarkCgroupNft()
+			}
+			return err
+		}
+	}
+	return changes.record(Change{Kind: changeNft})
+}
+
+// unmarkCgroupNft 删除 markCgroupNft 添加的表
+func unmarkCgroupNft() error {
+	return run("nft", "delete", "table", "inet", nftTable)
+}
+
+// setRPFilter 把网卡的反向路径过滤设置为宽松模式，原来的值记录在 changes 中。
+// 标记后重新选路的数据包保留原网卡的源地址，严格模式会丢弃从 TUN 返回的应答
+func setRPFilter(dev string, changes *Changes) error {
+	path := rpFilterPath(dev)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read rp_filter of %s: %w", dev, err)
+	}
+	old := strings.TrimSpace(string(b))
+	if old == "2" {
+		return nil
+	}
+	if err := os.WriteFile(path, []byte("2"), 0); err != nil {
+		return fmt.Errorf("set rp_filter of %s: %w", dev, err)
+	}
+	return changes.record(Change{Kind: changeRPFilter, Dev: dev, Value: old})
+}
+
+// restoreRPFilter 恢复 setRPFilter 修改前的值
+func restoreRPFilter(dev string, value string) error {
+	switch value {
+	case "0", "1", "2":
+	default:
+		return fmt.Errorf("invalid rp_filter value %q", value)
+	}
+	return os.WriteFile(rpFilterPath(dev), []byte(value), 0)
+}
+
+func rpFilterPath(dev string) string {
+	return filepath.Join("/proc/sys/net/ipv4/conf", filepath.Base(dev), "rp_filter")
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package tun
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var errCgroup = fmt.Errorf("cgroup: unsupported on %s", runtime.GOOS)
+
+// JoinCgroup 把当前进程移入 cgroup，只支持 Linux
+func JoinCgroup(path string) error { return errCgroup }
+
+func createCgroup(path string) error { return errCgroup }
+
+func markCgroup(path string, mark int, changes *Changes) error { return errCgroup }
+
+func unmarkCgroupNft() error { return errCgroup }
+
+func unmarkCgroupIptables(ipv6 bool, path string, mark int) error { return errCgroup }
+
+func setRPFilter(dev string, changes *Changes) error { return errCgroup }
+
+func restoreRPFilter(dev string, value string) error { return errCgroup }
@@ -0,0 +1,293 @@
+package tun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+// Change 是 tun 包对系统网络配置做的一项修改
+// 状态文件只保存结构化的数据，撤销时的命令由代码按固定格式重建
+type Change struct {
+	Kind    string       `json:"kind"` // "addr"、"route"、"rule"、"rp_filter"、"nft" 或 "iptables"
+	Dev     string       `json:"dev,omitempty"`
+	Prefix  netip.Prefix `json:"prefix"`
+	Gateway netip.Addr   `json:"gateway"`
+	Table   int          `json:"table,omitempty"`
+	Rule    *Rule        `json:"rule,omitempty"`
+
+	// "iptables" 添加的 cgroup 标记规则
+	IPv6   bool   `json:"ipv6,omitempty"`
+	Cgroup string `json:"cgroup,omitempty"`
+	Mark   int    `json:"mark,omitempty"`
+
+	// "rp_filter" 修改前的值
+	Value string `json:"value,omitempty"`
+}
+
+const (
+	changeAddr     = "addr"
+	changeRoute    = "route"
+	changeRule     = "rule"
+	changeRPFilter = "rp_filter"
+	changeNft      = "nft"
+	changeIptables = "iptables"
+)
+
+func (c Change) String() string {
+	switch c.Kind {
+	case changeAddr:
+		return fmt.Sprintf("address %s dev %s", c.Prefix, c.Dev)
+	case changeRule:
+		return fmt.Sprintf("rule %s", c.Rule)
+	case changeRPFilter:
+		return fmt.Sprintf("rp_filter %s of %s", c.Value, c.Dev)
+	case changeNft:
+		return "nft table inet " + nftTable
+	case changeIptables:
+		return fmt.Sprintf("%s cgroup %s mark %#x", iptablesCmd(c.IPv6), c.Cgroup, c.Mark)
+	}
+	return "route " + c.route().String()
+}
+
+func (c Change) route() Route {
+	return Route{Dst: c.Prefix, Gateway: c.Gateway, Dev: c.Dev, Table: c.Table}
+}
+
+// undo 撤销修改，Linux 上通过 netlink，其他系统通过 DelRoute。
+// 已经不存在的地址和路由视为撤销成功
+func (c Change) undo() error {
+	// 网卡删除时内核会一并删除它的地址和路由
+	if c.Dev != "" {
+		if _, err := net.InterfaceByName(c.Dev); err != nil {
+			return nil
+		}
+	}
+	err := c.del()
+	if errors.Is(err, syscall.ESRCH) || errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+	return err
+}
+
+func (c Change) del() error {
+	switch {
+	case c.Kind == changeAddr:
+		return AddrDel(c.Dev, c.Prefix)
+	case c.Kind == changeRule && c.Rule != nil:
+		return RuleDel(*c.Rule)
+	case c.Kind == changeRPFilter:
+		return restoreRPFilter(c.Dev, c.Value)
+	case c.Kind == changeNft:
+		return unmarkCgroupNft()
+	case c.Kind == changeIptables:
+		return unmarkCgroupIptables(c.IPv6, c.Cgroup, c.Mark)
+	case c.Kind != changeRoute:
+		return fmt.Errorf("unknown change %q", c.Kind)
+	case runtime.GOOS == "linux":
+		return RouteDel(c.route())
+	}
+	gw := ""
+	if c.Gateway.IsValid() {
+		gw = c.Gateway.String()
+	}
+	return DelRoute(c.Dev, gw, c.Prefix.String())
+}
+
+// Changes 记录安装的地址、路由和规则，Undo 时逆序撤销。设置了状态文件时每次变化都
+// 写入文件，进程异常退出后下次启动由 Recover 清理。
+// nil 的 *Changes 只执行操作，不做记录
+type Changes struct {
+	path string
+
+	mu   sync.Mutex
+	list []Change
+}
+
+// NewChanges 创建记录，path 为空时不写状态文件
+func NewChanges(path string) *Changes {
+	return &Changes{path: path}
+}
+
+// Recover 撤销上次运行留在状态文件中的修改并删除文件，文件不存在时什么都不做。
+// 不是当前用户所有或者其他用户可写的文件会被拒绝
+func Recover(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkStateFile(fi); err != nil {
+		return fmt.Errorf("refuse state file %s: %w", path, err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c := &Changes{path: path}
+	if err := json.Unmarshal(b, &c.list); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("read state file %s: %w", path, err)
+	}
+	// 只重试一次，仍然失败的修改需要手动清理
+	err = c.Undo()
+	os.Remove(path)
+	return err
+}
+
+// AddRoute 添加一条经过 TUN 设备的路由并记录，参数和 AddRoute 相同。
+// table 不为 0 时路由添加到该路由表，只支持 Linux
+func (c *Changes) AddRoute(tunDevice string, tunAddr string, cidr string, table int) error {
+	route, err := tunRoute(tunDevice, tunAddr, cidr)
+	if err != nil {
+		return err
+	}
+	route.Table = table
+	if runtime.GOOS == "linux" {
+		return c.addRoute(route)
+	}
+	if table != 0 {
+		return fmt.Errorf("add route %s: routing tables are unsupported on %s", route, runtime.GOOS)
+	}
+	if err := AddRoute(tunDevice, tunAddr, cidr); err != nil {
+		return err
+	}
+	return c.record(Change{Kind: changeRoute, Dev: route.Dev, Prefix: route.Dst, Gateway: route.Gateway})
+}
+
+// DelRoute 删除 AddRoute 添加的路由和它的记录
+func (c *Changes) DelRoute(tunDevice string, tunAddr string, cidr string, table int) error {
+	route, err := tunRoute(tunDevice, tunAddr, cidr)
+	if err != nil {
+		return err
+	}
+	route.Table = table
+	if runtime.GOOS == "linux" {
+		err = RouteDel(route)
+	} else {
+		err = DelRoute(tunDevice, tunAddr, cidr)
+	}
+	if err != nil {
+		return err
+	}
+	return c.forget(func(ch Change) bool {
+		return ch.Kind == changeRoute && ch.Dev == tunDevice && ch.Prefix == route.Dst && ch.Table == table
+	})
+}
+
+// addAddr 给网卡添加地址并记录
+func (c *Changes) addAddr(dev string, prefix netip.Prefix) error {
+	if err := AddrAdd(dev, prefix); err != nil {
+		return err
+	}
+	return c.record(Change{Kind: changeAddr, Dev: dev, Prefix: prefix})
+}
+
+// addRoute 通过 netlink 添加路由并记录
+func (c *Changes) addRoute(r Route) error {
+	if err := RouteAdd(r); err != nil {
+		return err
+	}
+	return c.record(Change{Kind: changeRoute, Dev: r.Dev, Prefix: r.Dst, Gateway: r.Gateway, Table: r.Table})
+}
+
+// addRule 添加策略路由规则并记录
+func (c *Changes) addRule(r Rule) error {
+	if err := RuleAdd(r); err != nil {
+		return err
+	}
+	return c.record(Change{Kind: changeRule, Rule: &r})
+}
+
+func (c *Changes) record(change Change) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.list = append(c.list, change)
+	return c.save()
+}
+
+func (c *Changes) forget(match func(Change) bool) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.list) - 1; i >= 0; i-- {
+		if match(c.list[i]) {
+			c.list = append(c.list[:i], c.list[i+1:]...)
+			return c.save()
+		}
+	}
+	return nil
+}
+
+// Undo 逆序撤销记录的修改。撤销失败的修改留在状态文件中，下次启动时由 Recover 再试
+func (c *Changes) Undo() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	var failed []Change
+	for i := len(c.list) - 1; i >= 0; i-- {
+		if err := c.list[i].undo(); err != nil {
+			errs = append(errs, fmt.Errorf("undo %s: %w", c.list[i], err))
+			failed = append([]Change{c.list[i]}, failed...)
+		}
+	}
+	c.list = failed
+	if err := c.save(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// save 把记录写入状态文件，没有记录时删除文件
+func (c *Changes) save() error {
+	if c.path == "" {
+		return nil
+	}
+	if len(c.list) == 0 {
+		if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.MarshalIndent(c.list, "", "  ")
+	if err != nil {
+		return err
+	}
+	// 临时文件名不可预测，不会跟随别人预先放置的符号链接
+	dir := filepath.Dir(c.path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
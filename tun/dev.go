@@ -18,6 +18,12 @@ func (conn DevReadWriteCloser) Write(buf []byte) (int, error) {
 	return conn.tunDev.Write(data, 0)
 }
 
+// Name 返回 TUN 设备名
+func (conn DevReadWriteCloser) Name() string {
+	name, _ := conn.tunDev.Name()
+	return name
+}
+
 func (conn DevReadWriteCloser) Close() error {
 	if conn.tunDev == nil {
 		return nil
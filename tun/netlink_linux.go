@@ -0,0 +1,456 @@
+//go:build linux
+
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// 通过 NETLINK_ROUTE socket 直接配置网卡和路由，不依赖 ip 命令。
+// 只需要 CAP_NET_ADMIN，可以在非特权的 user + network namespace 中运行
+
+var nlSeq atomic.Uint32
+
+// LinkSetUp 启用网卡
+func LinkSetUp(name string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	req := newRequest(unix.RTM_NEWLINK, 0, ifInfomsg(index, unix.IFF_UP, unix.IFF_UP))
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("set %s up: %w", name, err)
+	}
+	return nil
+}
+
+// LinkSetMTU 设置网卡 MTU
+func LinkSetMTU(name string, mtu int) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	req := newRequest(unix.RTM_NEWLINK, 0, ifInfomsg(index, 0, 0))
+	req.addUint32(unix.IFLA_MTU, uint32(mtu))
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("set %s mtu %d: %w", name, mtu, err)
+	}
+	return nil
+}
+
+// AddrAdd 给网卡添加地址，prefix 同时给出地址和网段
+func AddrAdd(name string, prefix netip.Prefix) error {
+	req, err := addrRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, name, prefix)
+	if err == nil {
+		err = req.execute()
+	}
+	if err != nil {
+		return fmt.Errorf("add address %s dev %s: %w", prefix, name, err)
+	}
+	return nil
+}
+
+// AddrDel 删除 AddrAdd 添加的地址
+func AddrDel(name string, prefix netip.Prefix) error {
+	req, err := addrRequest(unix.RTM_DELADDR, 0, name, prefix)
+	if err == nil {
+		err = req.execute()
+	}
+	if err != nil {
+		return fmt.Errorf("delete address %s dev %s: %w", prefix, name, err)
+	}
+	return nil
+}
+
+func addrRequest(typ uint16, flags uint16, name string, prefix netip.Prefix) (*nlRequest, error) {
+	index, err := linkIndex(name)
+	if err != nil {
+		return nil, err
+	}
+	addr := prefix.Addr()
+	msg := make([]byte, unix.SizeofIfAddrmsg)
+	msg[0] = family(addr)
+	msg[1] = byte(prefix.Bits())
+	if addr.Is6() {
+		// TUN 上没有其他主机，跳过重复地址检测，地址添加后立即可用
+		msg[2] = unix.IFA_F_NODAD
+	}
+	binary.NativeEndian.PutUint32(msg[4:], uint32(index))
+	req := newRequest(typ, flags, msg)
+	req.addAttr(unix.IFA_LOCAL, addr.AsSlice())
+	req.addAttr(unix.IFA_ADDRESS, addr.AsSlice())
+	return req, nil
+}
+
+// RouteAdd 添加路由，已存在相同路由时返回 EEXIST
+func RouteAdd(r Route) error {
+	req, err := routeRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, r)
+	if err == nil {
+		err = req.execute()
+	}
+	if err != nil {
+		return fmt.Errorf("add route %s: %w", r, err)
+	}
+	return nil
+}
+
+// RouteDel 删除路由
+func RouteDel(r Route) error {
+	req, err := routeRequest(unix.RTM_DELROUTE, 0, r)
+	if err == nil {
+		err = req.execute()
+	}
+	if err != nil {
+		return fmt.Errorf("delete route %s: %w", r, err)
+	}
+	return nil
+}
+
+func routeRequest(typ uint16, flags uint16, r Route) (*nlRequest, error) {
+	if !r.Dst.IsValid() {
+		return nil, errors.New("no destination")
+	}
+	scope := byte(unix.RT_SCOPE_UNIVERSE)
+	if !r.Gateway.IsValid() {
+		scope = unix.RT_SCOPE_LINK
+	}
+	if typ == unix.RTM_DELROUTE {
+		// 和 ip route del 一样，删除时不限定 scope
+		scope = unix.RT_SCOPE_NOWHERE
+	}
+	msg := rtMsg(r.Dst.Addr(), r.Dst.Bits(), scope)
+	if r.Table != 0 {
+		msg[4] = unix.RT_TABLE_UNSPEC
+	}
+	req := newRequest(typ, flags, msg)
+	if r.Table != 0 {
+		req.addUint32(unix.RTA_TABLE, uint32(r.Table))
+	}
+	req.addAttr(unix.RTA_DST, r.Dst.Addr().AsSlice())
+	if r.Gateway.IsValid() {
+		req.addAttr(unix.RTA_GATEWAY, r.Gateway.AsSlice())
+	}
+	if r.Dev != "" {
+		index, err := linkIndex(r.Dev)
+		if err != nil {
+			return nil, err
+		}
+		req.addUint32(unix.RTA_OIF, uint32(index))
+	}
+	return req, nil
+}
+
+// RuleAdd 添加策略路由规则
+func RuleAdd(r Rule) error {
+	if err := ruleRequest(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, r).execute(); err != nil {
+		return fmt.Errorf("add rule %s: %w", r, err)
+	}
+	return nil
+}
+
+// RuleDel 删除策略路由规则
+func RuleDel(r Rule) error {
+	if err := ruleRequest(unix.RTM_DELRULE, 0, r).execute(); err != nil {
+		return fmt.Errorf("delete rule %s: %w", r, err)
+	}
+	return nil
+}
+
+func ruleRequest(typ uint16, flags uint16, r Rule) *nlRequest {
+	// fib_rule_hdr 和 rtmsg 的布局相同，第 8 字节是 action，之后是 flags
+	msg := make([]byte, unix.SizeofRtMsg)
+	msg[0] = unix.AF_INET
+	if r.IPv6 {
+		msg[0] = unix.AF_INET6
+	}
+	msg[7] = unix.FR_ACT_TO_TBL
+	if r.Mark != 0 && r.Not {
+		binary.NativeEndian.PutUint32(msg[8:], unix.FIB_RULE_INVERT)
+	}
+	req := newRequest(typ, flags, msg)
+	req.addUint32(unix.FRA_TABLE, uint32(r.Table))
+	req.addUint32(unix.FRA_PRIORITY, uint32(r.Priority))
+	if r.Mark != 0 {
+		req.addUint32(unix.FRA_FWMARK, uint32(r.Mark))
+		req.addUint32(unix.FRA_FWMASK, 0xffffffff)
+	}
+	if r.SuppressDefault {
+		req.addUint32(unix.FRA_SUPPRESS_PREFIXLEN, 0)
+	}
+	return req
+}
+
+// RouteGet 查询内核访问 addr 时使用的路由，相当于 ip route get
+func RouteGet(addr netip.Addr) (Route, error) {
+	req := newRequest(unix.RTM_GETROUTE, 0, rtMsg(addr, addr.BitLen(), 0))
+	req.addAttr(unix.RTA_DST, addr.AsSlice())
+	msgs, err := req.query()
+	if err != nil {
+		return Route{}, fmt.Errorf("get route to %s: %w", addr, err)
+	}
+	for _, m := range msgs {
+		if r, ok := parseRoute(m); ok {
+			return r.Route, nil
+		}
+	}
+	return Route{}, fmt.Errorf("get route to %s: no route", addr)
+}
+
+// DefaultRoute 返回 main 表中 metric 最小的默认路由，ipv6 为 true 时查询 IPv6
+func DefaultRoute(ipv6 bool) (Route, error) {
+	var rtm []byte
+	if ipv6 {
+		rtm = rtMsg(netip.IPv6Unspecified(), 0, 0)
+	} else {
+		rtm = rtMsg(netip.IPv4Unspecified(), 0, 0)
+	}
+	msgs, err := newRequest(unix.RTM_GETROUTE, unix.NLM_F_DUMP, rtm).query()
+	if err != nil {
+		return Route{}, fmt.Errorf("read default route: %w", err)
+	}
+	var best routeMsg
+	for _, m := range msgs {
+		r, ok := parseRoute(m)
+		if !ok || r.Dst.Bits() != 0 || r.table != unix.RT_TABLE_MAIN || r.typ != unix.RTN_UNICAST {
+			continue
+		}
+		if !best.Dst.IsValid() || r.metric < best.metric {
+			best = r
+		}
+	}
+	if !best.Dst.IsValid() {
+		if ipv6 {
+			return Route{}, errors.New("no IPv6 default route")
+		}
+		return Route{}, errors.New("no IPv4 default route")
+	}
+	return best.Route, nil
+}
+
+// routeMsg 是从 RTM_NEWROUTE 消息中解析出的路由
+type routeMsg struct {
+	Route
+	metric uint32
+	table  uint32
+	typ    byte
+}
+
+func parseRoute(m nlMessage) (r routeMsg, ok bool) {
+	if m.typ != unix.RTM_NEWROUTE || len(m.data) < unix.SizeofRtMsg {
+		return r, false
+	}
+	fam, dstLen := m.data[0], int(m.data[1])
+	r.table, r.typ = uint32(m.data[4]), m.data[7]
+	dst := netip.IPv4Unspecified()
+	if fam == unix.AF_INET6 {
+		dst = netip.IPv6Unspecified()
+	}
+	for _, a := range parseAttrs(m.data[unix.SizeofRtMsg:]) {
+		switch a.typ {
+		case unix.RTA_DST:
+			dst, _ = netip.AddrFromSlice(a.value)
+		case unix.RTA_GATEWAY:
+			r.Gateway, _ = netip.AddrFromSlice(a.value)
+		case unix.RTA_OIF:
+			if len(a.value) == 4 {
+				if ifce, err := net.InterfaceByIndex(int(binary.NativeEndian.Uint32(a.value))); err == nil {
+					r.Dev = ifce.Name
+				}
+			}
+		case unix.RTA_PRIORITY:
+			if len(a.value) == 4 {
+				r.metric = binary.NativeEndian.Uint32(a.value)
+			}
+		case unix.RTA_TABLE:
+			if len(a.value) == 4 {
+				r.table = binary.NativeEndian.Uint32(a.value)
+			}
+		}
+	}
+	r.Dst = netip.PrefixFrom(dst, dstLen)
+	return r, r.Dst.IsValid()
+}
+
+func linkIndex(name string) (int, error) {
+	ifce, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("link %s: %w", name, err)
+	}
+	return ifce.Index, nil
+}
+
+func family(addr netip.Addr) byte {
+	if addr.Is4() {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+func ifInfomsg(index int, flags, change uint32) []byte {
+	msg := make([]byte, unix.SizeofIfInfomsg)
+	msg[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(msg[4:], uint32(index))
+	binary.NativeEndian.PutUint32(msg[8:], flags)
+	binary.NativeEndian.PutUint32(msg[12:], change)
+	return msg
+}
+
+// rtMsg 生成 main 表单播路由的 rtmsg
+func rtMsg(dst netip.Addr, bits int, scope byte) []byte {
+	msg := make([]byte, unix.SizeofRtMsg)
+	msg[0] = family(dst)
+	msg[1] = byte(bits)
+	msg[4] = unix.RT_TABLE_MAIN
+	msg[5] = unix.RTPROT_BOOT
+	msg[6] = scope
+	msg[7] = unix.RTN_UNICAST
+	return msg
+}
+
+// nlRequest 是一条 rtnetlink 请求：固定头部之后跟若干属性
+type nlRequest struct {
+	typ   uint16
+	flags uint16
+	data  []byte
+}
+
+func newRequest(typ uint16, flags uint16, msg []byte) *nlRequest {
+	return &nlRequest{typ: typ, flags: flags, data: msg}
+}
+
+func (r *nlRequest) addAttr(typ uint16, value []byte) {
+	attr := make([]byte, rtaAlign(unix.SizeofRtAttr+len(value)))
+	binary.NativeEndian.PutUint16(attr, uint16(unix.SizeofRtAttr+len(value)))
+	binary.NativeEndian.PutUint16(attr[2:], typ)
+	copy(attr[unix.SizeofRtAttr:], value)
+	r.data = append(r.data, attr...)
+}
+
+func (r *nlRequest) addUint32(typ uint16, v uint32) {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	r.addAttr(typ, b)
+}
+
+// execute 发送请求并等待内核确认
+func (r *nlRequest) execute() error {
+	_, err := r.roundTrip(unix.NLM_F_ACK)
+	return err
+}
+
+// query 发送查询请求，返回内核的应答消息
+func (r *nlRequest) query() ([]nlMessage, error) {
+	return r.roundTrip(0)
+}
+
+func (r *nlRequest) roundTrip(flags uint16) ([]nlMessage, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("netlink bind: %w", err)
+	}
+
+	seq := nlSeq.Add(1)
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(r.data))
+	binary.NativeEndian.PutUint32(msg, uint32(unix.SizeofNlMsghdr+len(r.data)))
+	binary.NativeEndian.PutUint16(msg[4:], r.typ)
+	binary.NativeEndian.PutUint16(msg[6:], unix.NLM_F_REQUEST|r.flags|flags)
+	binary.NativeEndian.PutUint32(msg[8:], seq)
+	msg = append(msg, r.data...)
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("netlink send: %w", err)
+	}
+
+	var replies []nlMessage
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("netlink receive: %w", err)
+		}
+		// dump 的应答分多次读取，消息不能引用同一个缓冲区
+		msgs, err := parseMessages(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.seq != seq {
+				continue
+			}
+			switch m.typ {
+			case unix.NLMSG_DONE:
+				return replies, nil
+			case unix.NLMSG_ERROR:
+				if len(m.data) < 4 {
+					return nil, errors.New("netlink: short error message")
+				}
+				if errno := int32(binary.NativeEndian.Uint32(m.data)); errno != 0 {
+					return nil, unix.Errno(-errno)
+				}
+				return replies, nil
+			}
+			replies = append(replies, m)
+			// 非 dump 请求只有一条应答
+			if m.flags&unix.NLM_F_MULTI == 0 && flags&unix.NLM_F_ACK == 0 {
+				return replies, nil
+			}
+		}
+	}
+}
+
+type nlMessage struct {
+	typ   uint16
+	flags uint16
+	seq   uint32
+	data  []byte
+}
+
+func parseMessages(b []byte) ([]nlMessage, error) {
+	var msgs []nlMessage
+	for len(b) >= unix.SizeofNlMsghdr {
+		l := int(binary.NativeEndian.Uint32(b))
+		if l < unix.SizeofNlMsghdr || l > len(b) {
+			return nil, errors.New("netlink: malformed message")
+		}
+		msgs = append(msgs, nlMessage{
+			typ:   binary.NativeEndian.Uint16(b[4:]),
+			flags: binary.NativeEndian.Uint16(b[6:]),
+			seq:   binary.NativeEndian.Uint32(b[8:]),
+			data:  b[unix.SizeofNlMsghdr:l],
+		})
+		b = b[min(nlmAlign(l), len(b)):]
+	}
+	return msgs, nil
+}
+
+type nlAttr struct {
+	typ   uint16
+	value []byte
+}
+
+func parseAttrs(b []byte) []nlAttr {
+	var attrs []nlAttr
+	for len(b) >= unix.SizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(b))
+		if l < unix.SizeofRtAttr || l > len(b) {
+			break
+		}
+		attrs = append(attrs, nlAttr{typ: binary.NativeEndian.Uint16(b[2:]), value: b[unix.SizeofRtAttr:l]})
+		b = b[min(rtaAlign(l), len(b)):]
+	}
+	return attrs
+}
+
+func nlmAlign(l int) int { return (l + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1) }
+
+func rtaAlign(l int) int { return (l + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1) }
@@ -0,0 +1,197 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+// netnsEnv 标记测试进程已经在新的 namespace 中运行
+const netnsEnv = "TUN2SOCKS_TEST_NETNS"
+
+// inNetns 在新的 user + network namespace 中重新运行当前测试，不需要 root，
+// 也不会改动主机的网络配置。返回 true 时调用者已经在 namespace 中，应继续测试
+func inNetns(t *testing.T) bool {
+	t.Helper()
+	if os.Getenv(netnsEnv) == "1" {
+		return true
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), netnsEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Skipf("user and network namespaces unavailable: %v", err)
+	}
+	t.Logf("in namespace:\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return false
+}
+
+func TestNetlinkLink(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+	if err := LinkSetUp("lo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := LinkSetMTU("lo", 1400); err != nil {
+		t.Fatal(err)
+	}
+	ifce, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ifce.Flags&net.FlagUp == 0 {
+		t.Errorf("lo is down after LinkSetUp")
+	}
+	if ifce.MTU != 1400 {
+		t.Errorf("lo mtu = %d, want 1400", ifce.MTU)
+	}
+	if err := LinkSetUp("missing0"); err == nil {
+		t.Errorf("LinkSetUp of a missing link succeeded")
+	}
+}
+
+func TestNetlinkAddr(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+	if err := LinkSetUp("lo"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []string{"10.1.2.3/24", "fd00::3/64"}
+	for _, tt := range tests {
+		t.Run(tt, func(t *testing.T) {
+			prefix := netip.MustParsePrefix(tt)
+			if prefix.Addr().Is6() {
+				if _, err := os.Stat("/proc/sys/net/ipv6"); err != nil {
+					t.Skip("IPv6 is disabled")
+				}
+			}
+			if err := AddrAdd("lo", prefix); err != nil {
+				t.Fatal(err)
+			}
+			if !hasAddr(t, prefix) {
+				t.Errorf("%s missing after AddrAdd", prefix)
+			}
+			if err := AddrAdd("lo", prefix); !errors.Is(err, syscall.EEXIST) {
+				t.Errorf("second AddrAdd: got %v, want EEXIST", err)
+			}
+			if err := AddrDel("lo", prefix); err != nil {
+				t.Fatal(err)
+			}
+			if hasAddr(t, prefix) {
+				t.Errorf("%s still present after AddrDel", prefix)
+			}
+		})
+	}
+}
+
+func hasAddr(t *testing.T, prefix netip.Prefix) bool {
+	t.Helper()
+	ifce, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := ifce.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		if a.String() == prefix.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNetlinkRoute(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+	if err := LinkSetUp("lo"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		route Route
+		probe string
+		found bool // RouteGet 查询 main 表时能否找到
+	}{
+		{Route{Dst: netip.MustParsePrefix("10.9.0.0/24"), Dev: "lo"}, "10.9.0.1", true},
+		{Route{Dst: netip.MustParsePrefix("0.0.0.0/0"), Dev: "lo"}, "192.0.2.1", true},
+		{Route{Dst: netip.MustParsePrefix("10.8.0.0/24"), Dev: "lo", Table: 100}, "10.8.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.route.String(), func(t *testing.T) {
+			probe := netip.MustParseAddr(tt.probe)
+			if err := RouteAdd(tt.route); err != nil {
+				t.Fatal(err)
+			}
+			got, err := RouteGet(probe)
+			if tt.found && (err != nil || got.Dev != "lo") {
+				t.Errorf("RouteGet(%s) = %v, %v; want dev lo", probe, got, err)
+			}
+			if !tt.found && err == nil {
+				t.Errorf("RouteGet(%s) = %v; want no route in main", probe, got)
+			}
+			if tt.route.Dst.Bits() == 0 {
+				if def, err := DefaultRoute(false); err != nil || def.Dev != "lo" {
+					t.Errorf("DefaultRoute = %v, %v; want dev lo", def, err)
+				}
+			}
+			if err := RouteAdd(tt.route); !errors.Is(err, syscall.EEXIST) {
+				t.Errorf("second RouteAdd: got %v, want EEXIST", err)
+			}
+			if err := RouteDel(tt.route); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := RouteGet(probe); err == nil {
+				t.Errorf("RouteGet(%s) = %v after RouteDel; want no route", probe, got)
+			}
+			if err := RouteDel(tt.route); !errors.Is(err, syscall.ESRCH) {
+				t.Errorf("second RouteDel: got %v, want ESRCH", err)
+			}
+		})
+	}
+}
+
+func TestNetlinkRule(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+	tests := []Rule{
+		{Priority: 9001, Table: 2022, Mark: 0x2022, Not: true},
+		{Priority: 9000, Table: tableMain, SuppressDefault: true},
+		{Priority: 9001, Table: 2022, Mark: 0x2023},
+	}
+	for _, r := range tests {
+		t.Run(r.String(), func(t *testing.T) {
+			if err := RuleAdd(r); err != nil {
+				t.Fatal(err)
+			}
+			if err := RuleAdd(r); !errors.Is(err, syscall.EEXIST) {
+				t.Errorf("second RuleAdd: got %v, want EEXIST", err)
+			}
+			if err := RuleDel(r); err != nil {
+				t.Fatal(err)
+			}
+			if err := RuleDel(r); !errors.Is(err, syscall.ENOENT) {
+				t.Errorf("second RuleDel: got %v, want ENOENT", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+package tun
+
+import (
+	"fmt"
+	"net/netip"
+	"runtime"
+)
+
+var errNetlink = fmt.Errorf("netlink: unsupported on %s", runtime.GOOS)
+
+func LinkSetUp(name string) error { return errNetlink }
+
+func LinkSetMTU(name string, mtu int) error { return errNetlink }
+
+func AddrAdd(name string, prefix netip.Prefix) error { return errNetlink }
+
+func AddrDel(name string, prefix netip.Prefix) error { return errNetlink }
+
+func RouteAdd(r Route) error { return errNetlink }
+
+func RouteDel(r Route) error { return errNetlink }
+
+func RuleAdd(r Rule) error { return errNetlink }
+
+func RuleDel(r Rule) error { return errNetlink }
+
+func RouteGet(addr netip.Addr) (Route, error) { return Route{}, errNetlink }
+
+func DefaultRoute(ipv6 bool) (Route, error) { return Route{}, errNetlink }
@@ -5,7 +5,6 @@ package tun
 
 import (
 	"fmt"
-	"net"
 	"os/exec"
 	"runtime"
 	"strconv"
@@ -15,44 +14,6 @@ import (
 	"golang.zx2c4.com/wireguard/tun"
 )
 
-func GetCidrIpRange(cidr string) (string, string) {
-	ip := strings.Split(cidr, "/")[0]
-	ipSegs := strings.Split(ip, ".")
-	maskLen, _ := strconv.Atoi(strings.Split(cidr, "/")[1])
-	seg3MinIp, seg3MaxIp := getIpSeg3Range(ipSegs, maskLen)
-	seg4MinIp, seg4MaxIp := getIpSeg4Range(ipSegs, maskLen)
-	ipPrefix := ipSegs[0] + "." + ipSegs[1] + "."
-
-	return ipPrefix + strconv.Itoa(seg3MinIp) + "." + strconv.Itoa(seg4MinIp),
-		ipPrefix + strconv.Itoa(seg3MaxIp) + "." + strconv.Itoa(seg4MaxIp)
-}
-
-// 得到第四段IP的区间（第一片段.第二片段.第三片段.第四片段）
-func getIpSeg4Range(ipSegs []string, maskLen int) (int, int) {
-	ipSeg, _ := strconv.Atoi(ipSegs[3])
-	segMinIp, segMaxIp := getIpSegRange(uint8(ipSeg), uint8(32-maskLen))
-	return segMinIp + 1, segMaxIp
-}
-
-// 得到第三段IP的区间（第一片段.第二片段.第三片段.第四片段）
-func getIpSeg3Range(ipSegs []string, maskLen int) (int, int) {
-	if maskLen > 24 {
-		segIp, _ := strconv.Atoi(ipSegs[2])
-		return segIp, segIp
-	}
-	ipSeg, _ := strconv.Atoi(ipSegs[2])
-	return getIpSegRange(uint8(ipSeg), uint8(24-maskLen))
-}
-
-// 根据用户输入的基础IP地址和CIDR掩码计算一个IP片段的区间
-func getIpSegRange(userSegIp, offset uint8) (int, int) {
-	var ipSegMax uint8 = 255
-	netSegIp := ipSegMax << offset
-	segMinIp := netSegIp & userSegIp
-	segMaxIp := userSegIp&(255<<offset) | ^(255 << offset)
-	return int(segMinIp), int(segMaxIp)
-}
-
 func GetWaterConf(tunDevName string, tunAddr string, tunMask string) water.Config {
 	config := water.Config{
 		DeviceType: water.TUN,
@@ -62,7 +23,10 @@ func GetWaterConf(tunDevName string, tunAddr string, tunMask string) water.Confi
 }
 
 /*windows linux mac use tun dev*/
-func RegTunDev(tunDevice string, mtu int, tunAddr string, tunMask string, routers []string) (*water.Interface, error) {
+// autoRoute 不为空时在 Linux 上安装全局模式路由，见 AutoRoute；policy 不为空时
+// 路由安装到专用路由表，见 Policy。添加的地址、路由和规则记录在 changes 中，
+// 失败时由调用者撤销
+func RegTunDev(tunDevice string, mtu int, tunAddr string, tunMask string, routers []string, autoRoute *AutoRoute, policy *Policy, changes *Changes) (*water.Interface, error) {
 	if len(tunDevice) == 0 {
 		tunDevice = "utun6"
 	}
@@ -80,26 +44,91 @@ func RegTunDev(tunDevice string, mtu int, tunAddr string, tunMask string, router
 		return nil, err
 	}
 
-	if runtime.GOOS == "linux" {
-		//sudo ip addr add 10.1.0.10/24 dev O_O
-		masks := net.ParseIP(tunMask).To4()
-		maskAddr := net.IPNet{IP: net.ParseIP(tunAddr), Mask: net.IPv4Mask(masks[0], masks[1], masks[2], masks[3])}
-		CmdHide("ip", "addr", "add", maskAddr.String(), "dev", ifce.Name()).Run()
-		CmdHide("ip", "link", "set", "dev", ifce.Name(), "up").Run()
+	if policy != nil && runtime.GOOS != "linux" {
+		ifce.Close()
+		return nil, fmt.Errorf("policy routing: unsupported on %s", runtime.GOOS)
+	}
+	if err := setupDev(ifce.Name(), mtu, tunAddr, tunMask, routers, true, policy.table(), changes); err != nil {
+		ifce.Close()
+		return nil, err
+	}
+	if autoRoute != nil {
+		if err := autoRoute.install(ifce.Name(), policy.table(), changes); err != nil {
+			ifce.Close()
+			return nil, err
+		}
+	}
+	if policy != nil {
+		if err := policy.install(ifce.Name(), autoRoute != nil, changes); err != nil {
+			ifce.Close()
+			return nil, err
+		}
+	}
+	return ifce, nil
+}
+
+// setupDev 配置网卡地址并启用，然后添加 routers 的路由。Linux 上通过 netlink
+// 完成，via 为 true 时 IPv4 路由以网卡的 IPv4 地址为网关，否则直接指定网卡，
+// IPv6 路由总是直接指定网卡。table 不为 0 时路由添加到该路由表。
+// 添加的地址和路由记录在 changes 中
+func setupDev(name string, mtu int, tunAddr string, tunMask string, routers []string, via bool, table int, changes *Changes) error {
+	addrs, err := ParseAddrs(tunAddr, tunMask)
+	if err != nil {
+		return err
+	}
+	gw := Gateway4(addrs)
+	switch runtime.GOOS {
+	case "linux":
+		for _, prefix := range addrs {
+			if err := changes.addAddr(name, prefix); err != nil {
+				return err
+			}
+		}
+		if mtu > 0 {
+			if err := LinkSetMTU(name, mtu); err != nil {
+				return err
+			}
+		}
+		if err := LinkSetUp(name); err != nil {
+			return err
+		}
 		for _, r := range routers {
-			CmdHide("ip", "r", "add", r, "via", tunAddr).Run()
+			dst, err := parseRouter(r)
+			if err != nil {
+				return err
+			}
+			route := Route{Dst: dst, Dev: name, Table: table}
+			if via && dst.Addr().Is4() {
+				route.Gateway = gw
+			}
+			if err := changes.addRoute(route); err != nil {
+				return err
+			}
+		}
+	case "darwin":
+		for _, prefix := range addrs {
+			if prefix.Addr().Is4() {
+				//ifconfig utun2 10.1.0.10 10.1.0.20 up
+				ipMin, ipMax := GetCidrIpRange(prefix.String())
+				err = run("ifconfig", name, ipMin, ipMax, "up")
+			} else {
+				err = run("ifconfig", name, "inet6", prefix.Addr().String(), "prefixlen", strconv.Itoa(prefix.Bits()), "alias")
+			}
+			if err != nil {
+				return err
+			}
+		}
+		gwAddr := ""
+		if gw.IsValid() {
+			gwAddr = gw.String()
 		}
-	} else if runtime.GOOS == "darwin" {
-		//ifconfig utun2 10.1.0.10 10.1.0.20 up
-		masks := net.ParseIP(tunMask).To4()
-		maskAddr := net.IPNet{IP: net.ParseIP(tunAddr), Mask: net.IPv4Mask(masks[0], masks[1], masks[2], masks[3])}
-		ipMin, ipMax := GetCidrIpRange(maskAddr.String())
-		CmdHide("ifconfig", ifce.Name(), ipMin, ipMax, "up").Run()
 		for _, r := range routers {
-			CmdHide("ip", "r", "add", r, "via", tunAddr).Run()
+			if err := changes.AddRoute(name, gwAddr, r, table); err != nil {
+				return err
+			}
 		}
 	}
-	return ifce, nil
+	return nil
 }
 
 /*windows use wintun*/
@@ -122,26 +151,49 @@ func RegTunDevTest(tunDevice string, tunAddr string, tunMask string, routers []s
 	if err != nil {
 		return nil, err
 	}
-	if runtime.GOOS == "linux" {
-		//sudo ip addr add 10.1.0.10/24 dev O_O
-		masks := net.ParseIP(tunMask).To4()
-		maskAddr := net.IPNet{IP: net.ParseIP(tunAddr), Mask: net.IPv4Mask(masks[0], masks[1], masks[2], masks[3])}
-		CmdHide("ip", "addr", "add", maskAddr.String(), "dev", tunDevName).Run()
-		CmdHide("ip", "link", "set", "dev", tunDevName, "up").Run()
-		for _, router := range routers {
-			CmdHide("ip", "route", "add", router, "dev", tunDevName).Run()
+	if err := setupDev(tunDevName, mtu, tunAddr, tunMask, routers, false, 0, nil); err != nil {
+		tunDev.Close()
+		return nil, err
+	}
+	return &DevReadWriteCloser{tunDev.(*tun.NativeTun)}, nil
+}
+
+// AddRoute 添加一条经过 TUN 设备的路由，IPv6 路由直接指定设备
+func AddRoute(tunDevice string, tunAddr string, cidr string) error {
+	v6 := strings.Contains(cidr, ":")
+	switch runtime.GOOS {
+	case "linux":
+		route, err := tunRoute(tunDevice, tunAddr, cidr)
+		if err != nil {
+			return err
 		}
-	} else if runtime.GOOS == "darwin" {
-		//ifconfig utun2 10.1.0.10 10.1.0.20 up
-		masks := net.ParseIP(tunMask).To4()
-		maskAddr := net.IPNet{IP: net.ParseIP(tunAddr), Mask: net.IPv4Mask(masks[0], masks[1], masks[2], masks[3])}
-		ipMin, ipMax := GetCidrIpRange(maskAddr.String())
-		CmdHide("ifconfig", tunDevName, ipMin, ipMax, "up").Run()
-		for _, router := range routers {
-			CmdHide("route", "add", router, "-interface", tunDevName).Run()
+		return RouteAdd(route)
+	case "darwin":
+		if v6 {
+			return run("route", "-n", "add", "-inet6", cidr, "-interface", tunDevice)
 		}
+		return run("route", "-n", "add", "-net", cidr, "-interface", tunDevice)
 	}
-	return &DevReadWriteCloser{tunDev.(*tun.NativeTun)}, nil
+	return fmt.Errorf("add route %s: unsupported on %s", cidr, runtime.GOOS)
+}
+
+// DelRoute 删除 AddRoute 添加的路由
+func DelRoute(tunDevice string, tunAddr string, cidr string) error {
+	v6 := strings.Contains(cidr, ":")
+	switch runtime.GOOS {
+	case "linux":
+		route, err := tunRoute(tunDevice, tunAddr, cidr)
+		if err != nil {
+			return err
+		}
+		return RouteDel(route)
+	case "darwin":
+		if v6 {
+			return run("route", "-n", "delete", "-inet6", cidr, "-interface", tunDevice)
+		}
+		return run("route", "-n", "delete", "-net", cidr, "-interface", tunDevice)
+	}
+	return fmt.Errorf("delete route %s: unsupported on %s", cidr, runtime.GOOS)
 }
 
 func CmdHide(name string, arg ...string) *exec.Cmd {
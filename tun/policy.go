@@ -0,0 +1,107 @@
+package tun
+
+import (
+	"errors"
+	"syscall"
+)
+
+// DefaultRulePriority 是 Policy.Priority 为 0 时规则使用的优先级
+const DefaultRulePriority = 9000
+
+// DefaultRouteTable 是按应用分流时 Policy.Table 的默认值
+const DefaultRouteTable = 2022
+
+// DefaultSocketMark 是策略路由模式下没有指定 Policy.Mark 时出口连接使用的 mark，
+// mark 为 0 时规则不能排除任何数据包
+const DefaultSocketMark = 0x2022
+
+// DefaultCgroupMark 是按应用分流时 Policy.CgroupMark 的默认值
+const DefaultCgroupMark = 0x2023
+
+// nftTable 是按 cgroup 打标记的 nftables 表
+const nftTable = "tun2socks"
+
+// iptablesCmd 返回没有 nft 时打标记使用的命令
+func iptablesCmd(ipv6 bool) string {
+	if ipv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+// tableMain 是 main 路由表的 ID
+const tableMain = 254
+
+// Policy 策略路由模式，目前只支持 Linux：路由安装到专用的 Table 而不是 main 表，
+// 再添加规则让不带 Mark 的数据包查询 Table。这样不会和 VPN 客户端、Docker 在
+// main 表中的路由冲突，带 Mark 的出口流量也不会回到 TUN。
+//
+// Cgroup 不为空时按应用分流：只有该 cgroup v2 路径（不存在时创建）中的进程发出
+// 的数据包被防火墙打上 CgroupMark，只有它们查询 Table
+type Policy struct {
+	Table    int
+	Priority int
+	Mark     int
+
+	Cgroup     string
+	CgroupMark int
+}
+
+// table 返回路由要安装到的路由表，nil 表示 main 表
+func (p *Policy) table() int {
+	if p == nil {
+		return 0
+	}
+	return p.Table
+}
+
+// rules 返回要添加的规则。全局模式下 Table 中有覆盖所有地址的路由，先以 Priority
+// 查询忽略默认路由的 main 表，让局域网、Docker 等更具体的路由优先，Table 的规则
+// 使用 Priority+1
+func (p *Policy) rules(autoRoute bool) []Rule {
+	priority := p.Priority
+	if priority == 0 {
+		priority = DefaultRulePriority
+	}
+	var rules []Rule
+	for _, v6 := range []bool{false, true} {
+		if autoRoute {
+			rules = append(rules, Rule{IPv6: v6, Priority: priority, Table: tableMain, SuppressDefault: true})
+		}
+		if p.Cgroup != "" {
+			rules = append(rules, Rule{IPv6: v6, Priority: priority + 1, Table: p.Table, Mark: p.CgroupMark})
+		} else {
+			rules = append(rules, Rule{IPv6: v6, Priority: priority + 1, Table: p.Table, Mark: p.Mark, Not: true})
+		}
+	}
+	return rules
+}
+
+// install 添加规则并记录在 changes 中，内核不支持 IPv6 时跳过 IPv6 规则。
+// 按应用分流时先创建 cgroup 并添加打标记的防火墙规则
+func (p *Policy) install(tunDevice string, autoRoute bool, changes *Changes) error {
+	if p.Cgroup == "" && p.Mark == 0 {
+		return errors.New("policy routing needs a non-zero mark")
+	}
+	if p.Cgroup != "" {
+		if err := createCgroup(p.Cgroup); err != nil {
+			return err
+		}
+		if err := setRPFilter(tunDevice, changes); err != nil {
+			return err
+		}
+		if err := markCgroup(p.Cgroup, p.CgroupMark, changes); err != nil {
+			return err
+		}
+	}
+	for _, r := range p.rules(autoRoute) {
+		err := changes.addRule(r)
+		if r.IPv6 && errors.Is(err, syscall.EAFNOSUPPORT) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package tun
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Route 是一条路由：Dst 经 Gateway 从 Dev 发出，Gateway 为空表示直连。
+// Table 为 0 时路由在 main 表中
+type Route struct {
+	Dst     netip.Prefix
+	Gateway netip.Addr
+	Dev     string
+	Table   int
+}
+
+func (r Route) String() string {
+	s := r.Dst.String()
+	if r.Gateway.IsValid() {
+		s += " via " + r.Gateway.String()
+	}
+	if r.Dev != "" {
+		s += " dev " + r.Dev
+	}
+	if r.Table != 0 {
+		s += " table " + strconv.Itoa(r.Table)
+	}
+	return s
+}
+
+// Rule 是一条策略路由规则，让数据包查询 Table：
+//
+//	ip rule add [not] fwmark Mark table Table priority Priority
+//
+// Mark 为 0 时匹配所有数据包，Not 表示匹配不带 Mark 的数据包。
+// SuppressDefault 对应 suppress_prefixlength 0，忽略 Table 中的默认路由
+type Rule struct {
+	IPv6            bool `json:"ipv6,omitempty"`
+	Priority        int  `json:"priority"`
+	Table           int  `json:"table"`
+	Mark            int  `json:"mark,omitempty"`
+	Not             bool `json:"not,omitempty"`
+	SuppressDefault bool `json:"suppress_default,omitempty"`
+}
+
+func (r Rule) String() string {
+	s := "from all"
+	if r.Mark != 0 && r.Not {
+		s += fmt.Sprintf(" not fwmark %#x", r.Mark)
+	} else if r.Mark != 0 {
+		s += fmt.Sprintf(" fwmark %#x", r.Mark)
+	}
+	s += " lookup " + strconv.Itoa(r.Table)
+	if r.SuppressDefault {
+		s += " suppress_prefixlength 0"
+	}
+	s += " priority " + strconv.Itoa(r.Priority)
+	if r.IPv6 {
+		s = "-6 " + s
+	}
+	return s
+}
+
+// parseRouter 解析 -routers 中的网段，单个地址视为主机路由
+func parseRouter(r string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(r); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(r)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid route %q", r)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ParseAddrs 解析逗号分隔的网卡地址，例如 "10.0.0.2,fd00::2/64"。
+// 不带前缀长度时 IPv4 地址使用 mask，IPv6 地址为 /128
+func ParseAddrs(tunAddr string, tunMask string) ([]netip.Prefix, error) {
+	var addrs []netip.Prefix
+	for _, s := range strings.Split(tunAddr, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(s); err == nil {
+			addrs = append(addrs, netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()))
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tun address %q", s)
+		}
+		addr = addr.Unmap()
+		bits := addr.BitLen()
+		if addr.Is4() {
+			if bits, err = maskBits(tunMask); err != nil {
+				return nil, err
+			}
+		}
+		addrs = append(addrs, netip.PrefixFrom(addr, bits))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no tun address in %q", tunAddr)
+	}
+	return addrs, nil
+}
+
+// maskBits 把点分掩码转换成前缀长度
+func maskBits(mask string) (int, error) {
+	m, err := netip.ParseAddr(mask)
+	if err != nil || !m.Is4() {
+		return 0, fmt.Errorf("invalid tun mask %q", mask)
+	}
+	v := binary.BigEndian.Uint32(m.AsSlice())
+	ones := bits.LeadingZeros32(^v)
+	if v<<ones != 0 {
+		return 0, fmt.Errorf("invalid tun mask %q", mask)
+	}
+	return ones, nil
+}
+
+// Gateway4 返回第一个 IPv4 网卡地址，IPv4 路由以它为网关
+func Gateway4(addrs []netip.Prefix) netip.Addr {
+	for _, p := range addrs {
+		if p.Addr().Is4() {
+			return p.Addr()
+		}
+	}
+	return netip.Addr{}
+}
+
+// GetCidrIpRange 返回网段中第一个可用地址（网络地址的下一个）和最后一个地址，
+// 支持 IPv4 和 IPv6，无法解析时返回两个空串。/32、/128 这样的单地址网段两个都
+// 返回该地址本身；之前按字节计算的实现对 /32 返回的是该地址的下一个地址和它本身，
+// 并且不处理短于 /16 的掩码的前两段
+func GetCidrIpRange(cidr string) (string, string) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return "", ""
+	}
+	prefix = prefix.Masked()
+	first, last := prefix.Addr(), lastAddr(prefix)
+	if first != last {
+		first = first.Next()
+	}
+	return first.String(), last.String()
+}
+
+// lastAddr 返回网段中最后一个地址
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// tunRoute 生成经过 TUN 设备的路由，IPv4 以网卡地址为网关
+func tunRoute(tunDevice string, tunAddr string, cidr string) (Route, error) {
+	dst, err := parseRouter(cidr)
+	if err != nil {
+		return Route{}, err
+	}
+	route := Route{Dst: dst, Dev: tunDevice}
+	if gw, err := netip.ParseAddr(tunAddr); err == nil && dst.Addr().Is4() && gw.Is4() {
+		route.Gateway = gw
+	}
+	return route, nil
+}
+
+// run 执行命令，失败时把命令输出带进错误信息
+func run(name string, arg ...string) error {
+	out, err := CmdHide(name, arg...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(arg, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package tun
+
+import "testing"
+
+func TestGetCidrIpRange(t *testing.T) {
+	tests := []struct {
+		cidr        string
+		first, last string
+	}{
+		{"10.0.0.2/24", "10.0.0.1", "10.0.0.255"},
+		{"10.1.2.3/16", "10.1.0.1", "10.1.255.255"},
+		{"10.1.2.3/8", "10.0.0.1", "10.255.255.255"},
+		{"0.0.0.0/0", "0.0.0.1", "255.255.255.255"},
+		{"10.0.0.2/30", "10.0.0.1", "10.0.0.3"},
+		// /31 只有两个地址，网络地址之后只剩最后一个
+		{"10.0.0.2/31", "10.0.0.3", "10.0.0.3"},
+		// 单地址网段返回该地址本身
+		{"10.0.0.2/32", "10.0.0.2", "10.0.0.2"},
+		{"fd00::2/64", "fd00::1", "fd00::ffff:ffff:ffff:ffff"},
+		{"fd00::2/127", "fd00::3", "fd00::3"},
+		{"fd00::2/128", "fd00::2", "fd00::2"},
+		{"10.0.0.2", "", ""},
+		{"10.0.0.2/33", "", ""},
+	}
+	for _, tt := range tests {
+		first, last := GetCidrIpRange(tt.cidr)
+		if first != tt.first || last != tt.last {
+			t.Errorf("GetCidrIpRange(%s) = %s, %s; want %s, %s", tt.cidr, first, last, tt.first, tt.last)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkStateFile 确认状态文件是当前用户（以 root 运行时即 uid 0）所有、其他用户
+// 无权访问的普通文件，防止别人伪造的文件让 Recover 删除任意路由和防火墙规则
+func checkStateFile(fi os.FileInfo) error {
+	if !fi.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+	if perm := fi.Mode().Perm(); perm&0o077 != 0 {
+		return fmt.Errorf("mode %#o is wider than 0600", perm)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("not owned by uid %d", os.Geteuid())
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package tun
+
+import (
+	"errors"
+	"os"
+)
+
+// checkStateFile 确认状态文件是普通文件，Windows 上访问权限由所在目录的 ACL 决定
+func checkStateFile(fi os.FileInfo) error {
+	if !fi.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+	return nil
+}
@@ -9,11 +9,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/netip"
 	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 	"unsafe"
 
 	"golang.org/x/crypto/hkdf"
@@ -71,8 +71,20 @@ func init() {
 	}
 }
 
+// AutoRoute 全局模式路由，Windows 上暂不支持
+type AutoRoute struct {
+	Bypass    []netip.Addr
+	Interface string
+}
+
 /*windows use wintun*/
-func RegTunDev(tunDevice string, mtu int, tunAddr string, tunMask string, routers []string) (*DevReadWriteCloser, error) {
+func RegTunDev(tunDevice string, mtu int, tunAddr string, tunMask string, routers []string, autoRoute *AutoRoute, policy *Policy, changes *Changes) (*DevReadWriteCloser, error) {
+	if autoRoute != nil {
+		return nil, errors.New("auto route: unsupported on windows")
+	}
+	if policy != nil {
+		return nil, errors.New("policy routing: unsupported on windows")
+	}
 	if len(tunDevice) == 0 {
 		tunDevice = "socksTun0"
 	}
@@ -82,32 +94,86 @@ func RegTunDev(tunDevice string, mtu int, tunAddr string, tunMask string, router
 	if len(tunMask) == 0 {
 		tunMask = "255.255.255.0"
 	}
+	addrs, err := ParseAddrs(tunAddr, tunMask)
+	if err != nil {
+		return nil, err
+	}
 	tunDev, err := tun.CreateTUN(tunDevice, mtu)
 	if err != nil {
 		return nil, err
 	}
-	setInterfaceAddress4(tunDev.(*tun.NativeTun), tunAddr, tunMask)
-	for _, router := range routers {
-		CmdHide("route", "add", router, tunAddr).Run()
+	var v4, v6 []netip.Prefix
+	for _, prefix := range addrs {
+		if prefix.Addr().Is4() {
+			v4 = append(v4, prefix)
+		} else {
+			v6 = append(v6, prefix)
+		}
+	}
+	if err := setupDev(tunDev.(*tun.NativeTun), v4, v6, routers, changes); err != nil {
+		tunDev.Close()
+		return nil, err
 	}
 	return &DevReadWriteCloser{tunDev.(*tun.NativeTun)}, nil
 }
 
-func setInterfaceAddress4(tunDev *tun.NativeTun, addr, mask string) error {
-	luid := winipcfg.LUID(tunDev.LUID())
-	ipnet := net.IPNet{
-		IP:   net.ParseIP(addr).To4(),
-		Mask: net.IPMask(net.ParseIP(mask).To4()),
+// setupDev 设置网卡地址并添加路由，路由使用网卡的实际名字
+func setupDev(tunDev *tun.NativeTun, v4, v6 []netip.Prefix, routers []string, changes *Changes) error {
+	name, err := tunDev.Name()
+	if err != nil {
+		return err
+	}
+	if err := setInterfaceAddresses(tunDev, windows.AF_INET, v4); err != nil {
+		return fmt.Errorf("set IPv4 addresses of %s: %w", name, err)
+	}
+	if err := setInterfaceAddresses(tunDev, windows.AF_INET6, v6); err != nil {
+		return fmt.Errorf("set IPv6 addresses of %s: %w", name, err)
+	}
+	gw := ""
+	if len(v4) > 0 {
+		gw = v4[0].Addr().String()
 	}
-	addresses := append([]netip.Prefix{}, netip.MustParsePrefix(ipnet.String()))
-	err := luid.SetIPAddressesForFamily(windows.AF_INET, addresses)
+	for _, router := range routers {
+		if err := changes.AddRoute(name, gw, router, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setInterfaceAddresses(tunDev *tun.NativeTun, family winipcfg.AddressFamily, addresses []netip.Prefix) error {
+	if len(addresses) == 0 {
+		return nil
+	}
+	luid := winipcfg.LUID(tunDev.LUID())
+	err := luid.SetIPAddressesForFamily(family, addresses)
 	if errors.Is(err, windows.ERROR_OBJECT_ALREADY_EXISTS) {
-		cleanupAddressesOnDisconnectedInterfaces(windows.AF_INET, addresses)
-		err = luid.SetIPAddressesForFamily(windows.AF_INET, addresses)
+		cleanupAddressesOnDisconnectedInterfaces(family, addresses)
+		err = luid.SetIPAddressesForFamily(family, addresses)
 	}
 	return err
 }
 
+// AddRoute 添加一条经过 TUN 设备的路由，IPv6 路由直接指定设备
+func AddRoute(tunDevice string, tunAddr string, cidr string) error {
+	if strings.Contains(cidr, ":") {
+		return run("netsh", "interface", "ipv6", "add", "route", cidr, tunDevice)
+	}
+	return run("route", "add", cidr, tunAddr)
+}
+
+// DelRoute 删除 AddRoute 添加的路由。IPv4 路由同时指定网关，只删除经过 TUN
+// 的那一条，不影响到同一网段的其他路由
+func DelRoute(tunDevice string, tunAddr string, cidr string) error {
+	if strings.Contains(cidr, ":") {
+		return run("netsh", "interface", "ipv6", "delete", "route", cidr, tunDevice)
+	}
+	if tunAddr == "" {
+		return run("route", "delete", cidr)
+	}
+	return run("route", "delete", cidr, tunAddr)
+}
+
 func CmdHide(name string, arg ...string) *exec.Cmd {
 	return exec.Command(name, arg...)
 }